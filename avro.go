@@ -0,0 +1,74 @@
+package yastatsd
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// AVRO_METRIC_SCHEMA describes a message produced per metric,
+// AVRO_METRIC_BATCH_SCHEMA a batched message holding every metric of a flush.
+const (
+	AVRO_METRIC_SCHEMA = `{"type": "record", "name": "Metric", "namespace": "yastatsd", "fields": [
+	{"name": "bucket", "type": "string"},
+	{"name": "type", "type": "string"},
+	{"name": "timestamp", "type": "long"},
+	{"name": "values", "type": {"type": "map", "values": "double"}}]}`
+	AVRO_METRIC_BATCH_SCHEMA = `{"type": "array", "items": ` + AVRO_METRIC_SCHEMA + `}`
+)
+
+func appendAvroMetric(buf []byte, m *metricMessage) []byte {
+	buf = appendAvroString(buf, m.Bucket)
+	buf = appendAvroString(buf, m.Type)
+	buf = appendAvroLong(buf, m.Timestamp)
+
+	if len(m.Values) > 0 {
+		keys := make([]string, 0, len(m.Values))
+		for k := range m.Values {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		buf = appendAvroLong(buf, int64(len(keys)))
+
+		for _, k := range keys {
+			buf = appendAvroString(buf, k)
+			buf = appendAvroDouble(buf, m.Values[k])
+		}
+	}
+
+	return appendAvroLong(buf, 0)
+}
+
+func appendAvroMetrics(buf []byte, messages []metricMessage) []byte {
+	if len(messages) > 0 {
+		buf = appendAvroLong(buf, int64(len(messages)))
+
+		for i := range messages {
+			buf = appendAvroMetric(buf, &messages[i])
+		}
+	}
+
+	return appendAvroLong(buf, 0)
+}
+
+func appendAvroLong(buf []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+
+	return append(buf, tmp[:n]...)
+}
+
+func appendAvroString(buf []byte, s string) []byte {
+	buf = appendAvroLong(buf, int64(len(s)))
+
+	return append(buf, s...)
+}
+
+func appendAvroDouble(buf []byte, f float64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(f))
+
+	return append(buf, tmp[:]...)
+}
@@ -0,0 +1,108 @@
+package yastatsd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+type capturedPacket struct {
+	Timestamp int64  `json:"timestamp"`
+	Source    string `json:"source"`
+	Data      []byte `json:"data"`
+}
+
+type recorder struct {
+	mutex   sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func newRecorder(path string) (*recorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &recorder{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (r *recorder) Record(t time.Time, source string, data []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	err := r.encoder.Encode(&capturedPacket{Timestamp: t.UnixNano(), Source: source, Data: data})
+	if err != nil {
+		log.Printf("Error capturing packet from %s - %s", source, err)
+	}
+}
+
+func (r *recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.file.Close()
+}
+
+// Replay feeds captured packets to the server and flushes at the captured
+// timestamps. The server must not use a state file, so a replay can't
+// overwrite the state of a running server.
+func (s *Server) Replay(r io.Reader, speed float64) error {
+	if s.config.StateFile != "" {
+		return errors.New("Replay requires a config without state file")
+	}
+
+	flushInterval := time.Duration(s.config.FlushInterval) * time.Millisecond
+	decoder := json.NewDecoder(bufio.NewReader(r))
+
+	var flushAt, prev time.Time
+
+	for {
+		var packet capturedPacket
+
+		err := decoder.Decode(&packet)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		t := time.Unix(0, packet.Timestamp)
+
+		if flushAt.IsZero() {
+			flushAt = s.nextFlushTime(t)
+
+			// Timestamped metrics are checked against the last flush, so it
+			// has to be in captured time too.
+			s.mutex.Lock()
+			s.lastFlush = flushAt.Add(-flushInterval)
+			s.mutex.Unlock()
+		}
+
+		for !t.Before(flushAt) {
+			s.flushPeriod(flushAt.Add(-flushInterval), flushAt)
+			flushAt = flushAt.Add(flushInterval)
+		}
+
+		if speed > 0 && !prev.IsZero() && t.After(prev) {
+			time.Sleep(time.Duration(float64(t.Sub(prev)) / speed))
+		}
+
+		prev = t
+
+		s.HandlePacket(packet.Data)
+	}
+
+	if !flushAt.IsZero() {
+		s.flushPeriod(flushAt.Add(-flushInterval), flushAt)
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package yastatsd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCaptureReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yastatsd")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	capturePath := filepath.Join(dir, "capture.jsonl")
+
+	r, err := newRecorder(capturePath)
+	if err != nil {
+		t.Fatalf("Error opening capture file: %s", err)
+	}
+
+	start := time.Unix(1000, 0)
+	r.Record(start, "127.0.0.1:1000", []byte("hits:1|c|T1000\nhits:2|c"))
+	r.Record(start.Add(5*time.Second), "127.0.0.1:1000", []byte("hits:4|c"))
+	r.Record(start.Add(12*time.Second), "127.0.0.1:1001", []byte("hits:8|c"))
+	r.Close()
+
+	config := DefaultConfig()
+	config.File = FileConfig{Path: filepath.Join(dir, "metrics.jsonl"), Format: FILE_FORMAT_JSON}
+
+	server, err := New(config)
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	capture, err := os.Open(capturePath)
+	if err != nil {
+		t.Fatalf("Error opening capture file: %s", err)
+	}
+
+	defer capture.Close()
+
+	err = server.Replay(capture, 0)
+	if err != nil {
+		t.Fatalf("Error replaying capture: %s", err)
+	}
+
+	server.Stop()
+
+	data, _ := ioutil.ReadFile(config.File.Path)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	expectedCounts := []float64{7, 8}
+	expectedTimestamps := []int64{1010, 1020}
+	var flushesCount int
+
+	for scanner.Scan() {
+		var doc flushDocument
+
+		err = json.Unmarshal(scanner.Bytes(), &doc)
+		if err != nil {
+			t.Fatalf("Error decoding flush document: %s", err)
+		}
+
+		if flushesCount < len(expectedCounts) && doc.Counters["statsd.hits"].Value != expectedCounts[flushesCount] {
+			t.Errorf("Invalid counter value in flush %d. Expected: %v, Actual: %v",
+				flushesCount, expectedCounts[flushesCount], doc.Counters["statsd.hits"].Value)
+		}
+
+		if flushesCount < len(expectedTimestamps) && doc.Timestamp != expectedTimestamps[flushesCount] {
+			t.Errorf("Flush %d must use captured time. Expected: %d, Actual: %d",
+				flushesCount, expectedTimestamps[flushesCount], doc.Timestamp)
+		}
+
+		flushesCount++
+	}
+
+	if flushesCount != len(expectedCounts) {
+		t.Errorf("Wrong count of flushes. Expected: %d, Actual: %d", len(expectedCounts), flushesCount)
+	}
+}
+
+func TestReplayWithStateFile(t *testing.T) {
+	config := DefaultConfig()
+	config.StateFile = filepath.Join(os.TempDir(), "yastatsd-state.json")
+
+	server, err := New(config)
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	err = server.Replay(bytes.NewReader(nil), 0)
+	if err == nil {
+		t.Error("Replay must be rejected for config with state file")
+	}
+}
@@ -0,0 +1,304 @@
+package client
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evvvvr/yastatsd/internal/metric"
+)
+
+const (
+	DEFAULT_NETWORK                = "udp"
+	DEFAULT_UDP_MAX_PACKET_SIZE    = 1432
+	DEFAULT_STREAM_MAX_PACKET_SIZE = 8192
+	DEFAULT_FLUSH_INTERVAL_MSEC    = 100
+	DEFAULT_DIAL_TIMEOUT_MSEC      = 5000
+)
+
+var (
+	ErrInvalidBucket   = errors.New("Invalid bucket name")
+	ErrInvalidTag      = errors.New("Invalid tag")
+	ErrInvalidSetValue = errors.New("Invalid set value")
+)
+
+type Config struct {
+	Network       string
+	Address       string
+	Prefix        string
+	Tags          map[string]string
+	MaxPacketSize int
+	FlushInterval int
+	DialTimeout   int
+}
+
+type Client struct {
+	config   Config
+	isStream bool
+	mutex    sync.Mutex
+	conn     net.Conn
+	buf      []byte
+	rand     *rand.Rand
+	stop     chan struct{}
+	done     chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func New(config Config) (*Client, error) {
+	if config.Network == "" {
+		config.Network = DEFAULT_NETWORK
+	}
+
+	if config.Address == "" {
+		return nil, errors.New("Statsd address is not set")
+	}
+
+	c := &Client{config: config, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+	switch config.Network {
+	case "udp", "udp4", "udp6", "unixgram":
+		c.isStream = false
+	case "tcp", "tcp4", "tcp6", "unix":
+		c.isStream = true
+	default:
+		return nil, errors.New("Unknown network " + config.Network)
+	}
+
+	if config.Prefix != "" && !isValidBucket(config.Prefix) {
+		return nil, ErrInvalidBucket
+	}
+
+	if !areValidTags(config.Tags) {
+		return nil, ErrInvalidTag
+	}
+
+	if c.config.MaxPacketSize <= 0 {
+		c.config.MaxPacketSize = DEFAULT_UDP_MAX_PACKET_SIZE
+
+		if c.isStream {
+			c.config.MaxPacketSize = DEFAULT_STREAM_MAX_PACKET_SIZE
+		}
+	}
+
+	if c.config.FlushInterval == 0 {
+		c.config.FlushInterval = DEFAULT_FLUSH_INTERVAL_MSEC
+	}
+
+	if c.config.DialTimeout <= 0 {
+		c.config.DialTimeout = DEFAULT_DIAL_TIMEOUT_MSEC
+	}
+
+	err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	c.buf = make([]byte, 0, c.config.MaxPacketSize)
+
+	if c.config.FlushInterval > 0 {
+		c.stop = make(chan struct{})
+		c.done = make(chan struct{})
+
+		go c.flushLoop()
+	}
+
+	return c, nil
+}
+
+func (c *Client) Counter(bucket string, value float64, sampling float64, tags map[string]string) error {
+	return c.send(&metric.Metric{Bucket: bucket, FloatValue: value, Type: metric.Counter, Sampling: sampling}, tags)
+}
+
+func (c *Client) Increment(bucket string, tags map[string]string) error {
+	return c.Counter(bucket, 1, 1, tags)
+}
+
+func (c *Client) Timer(bucket string, value float64, sampling float64, tags map[string]string) error {
+	return c.send(&metric.Metric{Bucket: bucket, FloatValue: value, Type: metric.Timer, Sampling: sampling}, tags)
+}
+
+func (c *Client) Timing(bucket string, d time.Duration, sampling float64, tags map[string]string) error {
+	return c.Timer(bucket, float64(d)/float64(time.Millisecond), sampling, tags)
+}
+
+func (c *Client) Gauge(bucket string, value float64, tags map[string]string) error {
+	return c.send(&metric.Metric{Bucket: bucket, FloatValue: value, Type: metric.Gauge}, tags)
+}
+
+func (c *Client) GaugeDelta(bucket string, delta float64, tags map[string]string) error {
+	return c.send(&metric.Metric{Bucket: bucket, FloatValue: delta, Type: metric.Gauge, DoesGaugeHaveOperation: true}, tags)
+}
+
+func (c *Client) Set(bucket string, value string, tags map[string]string) error {
+	return c.send(&metric.Metric{Bucket: bucket, StringValue: value, Type: metric.Set}, tags)
+}
+
+func (c *Client) Flush() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.flush()
+}
+
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		if c.stop != nil {
+			close(c.stop)
+			<-c.done
+		}
+
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		c.closeErr = c.flush()
+
+		err := c.conn.Close()
+		if c.closeErr == nil {
+			c.closeErr = err
+		}
+	})
+
+	return c.closeErr
+}
+
+func (c *Client) send(m *metric.Metric, tags map[string]string) error {
+	if m.Sampling <= 0 || m.Sampling > 1 || (m.Type != metric.Counter && m.Type != metric.Timer) {
+		m.Sampling = 1
+	}
+
+	if !isValidBucket(m.Bucket) {
+		return ErrInvalidBucket
+	}
+
+	if !areValidTags(tags) {
+		return ErrInvalidTag
+	}
+
+	if m.Type == metric.Set && (m.StringValue == "" || strings.ContainsAny(m.StringValue, "|\n")) {
+		return ErrInvalidSetValue
+	}
+
+	if c.config.Prefix != "" {
+		m.Bucket = c.config.Prefix + "." + m.Bucket
+	}
+
+	m.Tags = mergeTags(c.config.Tags, tags)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if m.Sampling < 1 && c.rand.Float64() >= m.Sampling {
+		return nil
+	}
+
+	line := m.String()
+
+	if len(c.buf) > 0 && len(c.buf)+1+len(line) > c.config.MaxPacketSize {
+		err := c.flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(c.buf) > 0 {
+		c.buf = append(c.buf, '\n')
+	}
+
+	c.buf = append(c.buf, line...)
+
+	if len(c.buf) >= c.config.MaxPacketSize {
+		return c.flush()
+	}
+
+	return nil
+}
+
+func (c *Client) flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+
+	if c.isStream {
+		c.buf = append(c.buf, '\n')
+	}
+
+	_, err := c.conn.Write(c.buf)
+	c.buf = c.buf[:0]
+
+	if err != nil && c.isStream {
+		c.conn.Close()
+		c.dial()
+	}
+
+	return err
+}
+
+func (c *Client) dial() error {
+	conn, err := net.DialTimeout(c.config.Network, c.config.Address, time.Duration(c.config.DialTimeout)*time.Millisecond)
+	if err != nil {
+		return err
+	}
+
+	c.conn = conn
+
+	return nil
+}
+
+func (c *Client) flushLoop() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(time.Duration(c.config.FlushInterval) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.Flush()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func mergeTags(defaultTags map[string]string, tags map[string]string) map[string]string {
+	if len(defaultTags) == 0 {
+		return tags
+	}
+
+	if len(tags) == 0 {
+		return defaultTags
+	}
+
+	res := make(map[string]string, len(defaultTags)+len(tags))
+
+	for k, v := range defaultTags {
+		res[k] = v
+	}
+
+	for k, v := range tags {
+		res[k] = v
+	}
+
+	return res
+}
+
+// Names and tags are not escaped by the statsd line format, so the characters
+// that delimit it are rejected.
+func isValidBucket(bucket string) bool {
+	return bucket != "" && !strings.ContainsAny(bucket, ":|\n")
+}
+
+func areValidTags(tags map[string]string) bool {
+	for k, v := range tags {
+		if k == "" || v == "" || strings.ContainsAny(k, ":,|#\n") || strings.ContainsAny(v, ",|\n") {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,246 @@
+package client_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evvvvr/yastatsd"
+	"github.com/evvvvr/yastatsd/client"
+	"github.com/evvvvr/yastatsd/internal/metric"
+	"github.com/evvvvr/yastatsd/internal/parser"
+)
+
+func TestClientUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening UDP: %s", err)
+	}
+
+	defer conn.Close()
+
+	c, err := client.New(client.Config{Address: conn.LocalAddr().String(), Prefix: "app",
+		Tags: map[string]string{"env": "prod"}, FlushInterval: -1})
+	if err != nil {
+		t.Fatalf("Error creating client: %s", err)
+	}
+
+	defer c.Close()
+
+	c.Counter("hits", 2, 1, map[string]string{"host": "a"})
+	c.Timer("latency", 12.5, 1, nil)
+	c.Gauge("queue", -3, nil)
+	c.GaugeDelta("queue", 4, nil)
+	c.Set("users", "bob", nil)
+	c.Counter("never", 1, 0.000000001, nil)
+
+	err = c.Flush()
+	if err != nil {
+		t.Fatalf("Error flushing client: %s", err)
+	}
+
+	buf := make([]byte, 65535)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Error reading packet: %s", err)
+	}
+
+	metrics, errs := parser.Parse(string(buf[:n]))
+	if len(errs) != 0 {
+		t.Fatalf("Unexpected parsing errors: %v", errs)
+	}
+
+	prod := map[string]string{"env": "prod"}
+	expected := []metric.Metric{
+		{Bucket: "app.hits", FloatValue: 2, Type: metric.Counter, Sampling: 1, Tags: map[string]string{"env": "prod", "host": "a"}},
+		{Bucket: "app.latency", FloatValue: 12.5, Type: metric.Timer, Sampling: 1, Tags: prod},
+		{Bucket: "app.queue", FloatValue: -3, Type: metric.Gauge, Tags: prod},
+		{Bucket: "app.queue", FloatValue: 4, Type: metric.Gauge, DoesGaugeHaveOperation: true, Tags: prod},
+		{Bucket: "app.users", StringValue: "bob", Type: metric.Set, Tags: prod},
+	}
+
+	if len(metrics) != len(expected) {
+		t.Fatalf("Wrong count of metrics. Expected: %d, Actual: %d", len(expected), len(metrics))
+	}
+
+	for i := range expected {
+		if !expected[i].Equal(metrics[i]) {
+			t.Errorf("Metrics are not equal. Expected: %s, Actual: %s", &expected[i], metrics[i])
+		}
+	}
+}
+
+func TestClientPacketSize(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening UDP: %s", err)
+	}
+
+	defer conn.Close()
+
+	c, err := client.New(client.Config{Address: conn.LocalAddr().String(), MaxPacketSize: 40, FlushInterval: -1})
+	if err != nil {
+		t.Fatalf("Error creating client: %s", err)
+	}
+
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		c.Increment("some.counter", nil)
+	}
+
+	c.Flush()
+
+	buf := make([]byte, 65535)
+	var lines int
+
+	for lines < 10 {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Error reading packet: %s", err)
+		}
+
+		if n > 40 {
+			t.Errorf("Packet exceeds max size: %q", buf[:n])
+		}
+
+		lines += len(strings.Split(string(buf[:n]), "\n"))
+	}
+
+	if lines != 10 {
+		t.Errorf("Wrong count of lines. Expected: %d, Actual: %d", 10, lines)
+	}
+}
+
+func TestClientUnix(t *testing.T) {
+	address := filepath.Join(t.TempDir(), "statsd.sock")
+
+	listener, err := net.Listen("unix", address)
+	if err != nil {
+		t.Fatalf("Error listening unix socket: %s", err)
+	}
+
+	defer listener.Close()
+
+	c, err := client.New(client.Config{Network: "unix", Address: address})
+	if err != nil {
+		t.Fatalf("Error creating client: %s", err)
+	}
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Error accepting connection: %s", err)
+	}
+
+	defer conn.Close()
+
+	c.Timer("latency", 5, 1, nil)
+	c.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Error reading line: %s", err)
+	}
+
+	if line != "latency:5|ms\n" {
+		t.Errorf("Wrong line. Expected: %q, Actual: %q", "latency:5|ms\n", line)
+	}
+}
+
+func TestClientValidation(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening UDP: %s", err)
+	}
+
+	defer conn.Close()
+
+	_, err = client.New(client.Config{Address: conn.LocalAddr().String(), Tags: map[string]string{"a,b": "c"}})
+	if err != client.ErrInvalidTag {
+		t.Errorf("Invalid default tags must be rejected. Actual: %v", err)
+	}
+
+	c, err := client.New(client.Config{Address: conn.LocalAddr().String()})
+	if err != nil {
+		t.Fatalf("Error creating client: %s", err)
+	}
+
+	for _, bucket := range []string{"", "a:b", "a|b", "a\nb"} {
+		if err = c.Increment(bucket, nil); err != client.ErrInvalidBucket {
+			t.Errorf("Bucket %q must be rejected. Actual: %v", bucket, err)
+		}
+	}
+
+	for _, tags := range []map[string]string{{"": "a"}, {"a": ""}, {"a:b": "c"}, {"a": "b,c"}, {"a": "b|c"}} {
+		if err = c.Increment("hits", tags); err != client.ErrInvalidTag {
+			t.Errorf("Tags %v must be rejected. Actual: %v", tags, err)
+		}
+	}
+
+	if err = c.Set("users", "a|b", nil); err != client.ErrInvalidSetValue {
+		t.Errorf("Set value must be rejected. Actual: %v", err)
+	}
+
+	if err = c.Increment("hits", map[string]string{"url": "http://a"}); err != nil {
+		t.Errorf("Tag value may contain colons. Actual: %v", err)
+	}
+
+	if err = c.Close(); err != nil {
+		t.Errorf("Error closing client: %s", err)
+	}
+
+	if err = c.Close(); err != nil {
+		t.Errorf("Closing client twice must not fail. Actual: %v", err)
+	}
+}
+
+func TestClientServer(t *testing.T) {
+	config := yastatsd.DefaultConfig()
+	config.UdpServerAddress = ""
+	config.TcpServerAddress = "127.0.0.1:0"
+
+	server, err := yastatsd.New(config)
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err = server.Start(ctx)
+	if err != nil {
+		t.Fatalf("Error starting server: %s", err)
+	}
+
+	defer server.Stop()
+
+	c, err := client.New(client.Config{Network: "tcp", Address: server.TCPAddr().String()})
+	if err != nil {
+		t.Fatalf("Error creating client: %s", err)
+	}
+
+	c.Counter("hits", 3, 1, map[string]string{"env": "prod"})
+	c.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		if server.Snapshot().Counters["statsd.hits;env=prod"] == 3 {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("Tagged counter was not received. Snapshot: %v", server.Snapshot().Counters)
+}
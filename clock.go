@@ -0,0 +1,24 @@
+package yastatsd
+
+import "time"
+
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func alignTime(t time.Time, d time.Duration) time.Time {
+	ns := t.UnixNano()
+
+	return time.Unix(0, ns-ns%int64(d))
+}
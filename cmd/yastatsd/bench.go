@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evvvvr/yastatsd"
+	"github.com/evvvvr/yastatsd/internal/metric"
+)
+
+const (
+	DEFAULT_BENCH_ADDRESS     = "127.0.0.1:8125"
+	DEFAULT_BENCH_PACKET_SIZE = 1432
+	DEFAULT_BENCH_MIX         = "c=40,ms=40,g=10,s=10"
+)
+
+type benchGenerator struct {
+	rnd         *rand.Rand
+	prefix      string
+	buckets     int
+	sampling    float64
+	packetSize  int
+	types       []metric.MetricType
+	weights     []int
+	totalWeight int
+}
+
+type benchStats struct {
+	metrics int
+	packets int
+	bytes   int
+}
+
+func benchCommand(args []string) {
+	flags := flag.NewFlagSet(COMMAND_BENCH, flag.ExitOnError)
+	address := flags.String("address", DEFAULT_BENCH_ADDRESS, "target server address")
+	network := flags.String("network", "udp", "network to send metrics over: udp or tcp")
+	duration := flags.Duration("duration", 10*time.Second, "benchmark duration")
+	rate := flags.Int("rate", 0, "metrics per second to send, 0 sends as fast as possible")
+	mix := flags.String("mix", DEFAULT_BENCH_MIX, "weights of c, ms, g and s metrics")
+	buckets := flags.Int("buckets", 100, "bucket cardinality per metric type")
+	sampling := flags.Float64("sampling", 1, "sample rate of counters and timers")
+	packetSize := flags.Int("packet-size", DEFAULT_BENCH_PACKET_SIZE, "maximum packet size in bytes")
+	prefix := flags.String("prefix", "bench", "bucket name prefix")
+	seed := flags.Int64("seed", 1, "random seed")
+	graphiteListen := flags.String("graphite-listen", "",
+		"address to accept server flushes on, for comparing sent metrics with the server self-metrics")
+	statsPrefix := flags.String("stats-prefix", "statsd", "server self-metrics prefix")
+	wait := flags.Duration("wait", 2*yastatsd.DEFAULT_FLUSH_INTERVAL_MILLISECONDS*time.Millisecond,
+		"time to wait for server flushes after sending")
+	flags.Parse(args)
+
+	generator, err := newBenchGenerator(rand.New(rand.NewSource(*seed)), *prefix, *mix, *buckets, *sampling,
+		*packetSize)
+	if err != nil {
+		log.Fatalf("Invalid benchmark parameters: %s", err)
+	}
+
+	var received *benchReceived
+
+	if *graphiteListen != "" {
+		received, err = listenBenchGraphite(*graphiteListen, *statsPrefix)
+		if err != nil {
+			log.Fatalf("Error listening for Graphite flushes: %s", err)
+		}
+	}
+
+	conn, err := net.Dial(*network, *address)
+	if err != nil {
+		log.Fatalf("Error connecting to %s: %s", *address, err)
+	}
+
+	defer conn.Close()
+
+	log.Printf("Sending metrics to %s over %s for %s", *address, *network, *duration)
+
+	stats, elapsed := runBench(conn, generator, *duration, *rate)
+	seconds := elapsed.Seconds()
+
+	log.Printf("Sent %d metrics in %d packets (%d bytes) in %s", stats.metrics, stats.packets, stats.bytes, elapsed)
+	log.Printf("Send rate: %.0f metrics/s, %.0f packets/s, %.0f bytes/s",
+		float64(stats.metrics)/seconds, float64(stats.packets)/seconds, float64(stats.bytes)/seconds)
+
+	if received != nil {
+		log.Printf("Waiting %s for server flushes", *wait)
+		time.Sleep(*wait)
+
+		packets, metrics, errors := received.Totals()
+		loss := lossPercentage(stats.metrics, metrics)
+
+		log.Printf("Server received %.0f metrics in %.0f packets, %.0f bad lines, %.2f%% metrics lost",
+			metrics, packets, errors, loss)
+	}
+}
+
+func newBenchGenerator(rnd *rand.Rand, prefix string, mix string, buckets int, sampling float64,
+	packetSize int) (*benchGenerator, error) {
+	if buckets <= 0 {
+		return nil, fmt.Errorf("Bucket cardinality must be positive: %d", buckets)
+	}
+
+	if sampling <= 0 || sampling > 1 {
+		return nil, fmt.Errorf("Sample rate must be in (0, 1]: %s", strconv.FormatFloat(sampling, 'f', -1, 64))
+	}
+
+	g := benchGenerator{rnd: rnd, prefix: prefix, buckets: buckets, sampling: sampling, packetSize: packetSize}
+
+	for _, part := range strings.Split(mix, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid metric mix: %s", mix)
+		}
+
+		weight, err := strconv.Atoi(kv[1])
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("Invalid metric mix weight: %s", part)
+		}
+
+		var metricType metric.MetricType
+
+		switch kv[0] {
+		case "c":
+			metricType = metric.Counter
+
+		case "ms":
+			metricType = metric.Timer
+
+		case "g":
+			metricType = metric.Gauge
+
+		case "s":
+			metricType = metric.Set
+
+		default:
+			return nil, fmt.Errorf("Invalid metric type in mix: %s", kv[0])
+		}
+
+		g.types = append(g.types, metricType)
+		g.weights = append(g.weights, weight)
+		g.totalWeight += weight
+	}
+
+	if g.totalWeight == 0 {
+		return nil, fmt.Errorf("Invalid metric mix: %s", mix)
+	}
+
+	return &g, nil
+}
+
+func (g *benchGenerator) Metric() *metric.Metric {
+	n := g.rnd.Intn(g.totalWeight)
+	metricType := g.types[len(g.types)-1]
+
+	for i, weight := range g.weights {
+		if n < weight {
+			metricType = g.types[i]
+			break
+		}
+
+		n -= weight
+	}
+
+	m := metric.Metric{Type: metricType, Sampling: 1}
+
+	switch metricType {
+	case metric.Counter:
+		m.Bucket = fmt.Sprintf("%s.counter.%d", g.prefix, g.rnd.Intn(g.buckets))
+		m.FloatValue = float64(1 + g.rnd.Intn(10))
+		m.Sampling = g.sampling
+
+	case metric.Timer:
+		m.Bucket = fmt.Sprintf("%s.timer.%d", g.prefix, g.rnd.Intn(g.buckets))
+		m.FloatValue = float64(g.rnd.Intn(1000))
+		m.Sampling = g.sampling
+
+	case metric.Gauge:
+		m.Bucket = fmt.Sprintf("%s.gauge.%d", g.prefix, g.rnd.Intn(g.buckets))
+		m.FloatValue = float64(g.rnd.Intn(1000))
+
+	case metric.Set:
+		m.Bucket = fmt.Sprintf("%s.set.%d", g.prefix, g.rnd.Intn(g.buckets))
+		m.StringValue = strconv.Itoa(g.rnd.Intn(10000))
+	}
+
+	return &m
+}
+
+func (g *benchGenerator) Packet() ([]byte, int) {
+	var packet []byte
+	var metricsCount int
+
+	for {
+		line := g.Metric().String()
+
+		if len(packet) > 0 && len(packet)+1+len(line) > g.packetSize {
+			return packet, metricsCount
+		}
+
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+
+		packet = append(packet, line...)
+		metricsCount++
+
+		if len(packet) >= g.packetSize {
+			return packet, metricsCount
+		}
+	}
+}
+
+func runBench(conn net.Conn, g *benchGenerator, duration time.Duration, rate int) (benchStats, time.Duration) {
+	var stats benchStats
+	isStream := conn.LocalAddr().Network() != "udp"
+	start := time.Now()
+
+	for time.Since(start) < duration {
+		packet, metricsCount := g.Packet()
+
+		if isStream {
+			packet = append(packet, '\n')
+		}
+
+		_, err := conn.Write(packet)
+		if err != nil {
+			log.Printf("Error sending packet: %s", err)
+			break
+		}
+
+		stats.metrics += metricsCount
+		stats.packets++
+		stats.bytes += len(packet)
+
+		if rate > 0 {
+			expected := time.Duration(float64(stats.metrics) / float64(rate) * float64(time.Second))
+
+			if ahead := expected - time.Since(start); ahead > 0 {
+				time.Sleep(ahead)
+			}
+		}
+	}
+
+	return stats, time.Since(start)
+}
+
+type benchReceived struct {
+	mutex         sync.Mutex
+	packetsBucket string
+	metricsBucket string
+	errorsBucket  string
+	packets       float64
+	metrics       float64
+	errors        float64
+}
+
+func listenBenchGraphite(address string, statsPrefix string) (*benchReceived, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := ""
+	if statsPrefix != "" {
+		prefix = statsPrefix + "."
+	}
+
+	received := benchReceived{packetsBucket: prefix + yastatsd.PACKETS_RECIEVED_COUNTER + ".count",
+		metricsBucket: prefix + yastatsd.METRICS_RECIEVED_COUNTER + ".count",
+		errorsBucket:  prefix + yastatsd.ERRORS_COUNTER + ".count"}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go received.read(conn)
+		}
+	}()
+
+	return &received, nil
+}
+
+func (r *benchReceived) read(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) != 3 {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+
+		r.mutex.Lock()
+
+		switch fields[0] {
+		case r.packetsBucket:
+			r.packets += value
+
+		case r.metricsBucket:
+			r.metrics += value
+
+		case r.errorsBucket:
+			r.errors += value
+		}
+
+		r.mutex.Unlock()
+	}
+}
+
+func (r *benchReceived) Totals() (float64, float64, float64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.packets, r.metrics, r.errors
+}
+
+func lossPercentage(sent int, received float64) float64 {
+	if sent == 0 {
+		return 0
+	}
+
+	return 100 * (1 - received/float64(sent))
+}
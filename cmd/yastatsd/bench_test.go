@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/evvvvr/yastatsd/internal/parser"
+)
+
+func TestBenchGenerator(t *testing.T) {
+	g, err := newBenchGenerator(rand.New(rand.NewSource(1)), "bench", DEFAULT_BENCH_MIX, 10, 0.5, 512)
+	if err != nil {
+		t.Fatalf("Error creating generator: %s", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		packet, metricsCount := g.Packet()
+
+		if len(packet) > 512 {
+			t.Fatalf("Packet exceeds maximum size: %d", len(packet))
+		}
+
+		metrics, errs := parser.Parse(string(packet))
+
+		if len(errs) > 0 {
+			t.Fatalf("Error parsing generated packet: %s", errs[0])
+		}
+
+		if len(metrics) != metricsCount {
+			t.Fatalf("Wrong count of metrics in packet. Expected: %d, Actual: %d", metricsCount, len(metrics))
+		}
+	}
+}
+
+func TestBenchGeneratorParameters(t *testing.T) {
+	invalidMixes := []string{"", "c", "c=x", "x=1", "c=0,ms=0"}
+
+	for _, mix := range invalidMixes {
+		if _, err := newBenchGenerator(rand.New(rand.NewSource(1)), "bench", mix, 10, 1, 512); err == nil {
+			t.Errorf("Invalid mix %q must be rejected", mix)
+		}
+	}
+
+	if _, err := newBenchGenerator(rand.New(rand.NewSource(1)), "bench", DEFAULT_BENCH_MIX, 10, 0, 512); err == nil {
+		t.Error("Zero sample rate must be rejected")
+	}
+}
+
+func TestLossPercentage(t *testing.T) {
+	if loss := lossPercentage(0, 0); loss != 0 {
+		t.Errorf("Loss must be zero when nothing was sent. Actual: %v", loss)
+	}
+
+	if loss := lossPercentage(200, 150); loss != 25 {
+		t.Errorf("Wrong loss percentage. Expected: %v, Actual: %v", 25, loss)
+	}
+}
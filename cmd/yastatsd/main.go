@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/go-yaml/yaml"
+
+	"github.com/evvvvr/yastatsd"
+)
+
+const (
+	COMMAND_SERVE   = "serve"
+	COMMAND_CAPTURE = "capture"
+	COMMAND_REPLAY  = "replay"
+	COMMAND_BENCH   = "bench"
+
+	CONFIG_FILE          = "config.yaml"
+	DEFAULT_CAPTURE_FILE = "capture.jsonl"
+)
+
+func main() {
+	command := COMMAND_SERVE
+	args := os.Args[1:]
+
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case COMMAND_SERVE:
+		serve(mustLoadConfig(CONFIG_FILE))
+
+	case COMMAND_CAPTURE:
+		captureCommand(args)
+
+	case COMMAND_REPLAY:
+		err := replayCommand(args)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+	case COMMAND_BENCH:
+		benchCommand(args)
+
+	default:
+		log.Fatalf("Unknown command: %s", command)
+	}
+}
+
+func loadConfig(path string) (yastatsd.Config, error) {
+	config := yastatsd.DefaultConfig()
+
+	configFile, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("Error reading config file: %s", err)
+	}
+
+	err = yaml.Unmarshal(configFile, &config)
+	if err != nil {
+		return config, fmt.Errorf("Error reading config file: %s", err)
+	}
+
+	return config, nil
+}
+
+func mustLoadConfig(path string) yastatsd.Config {
+	config, err := loadConfig(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return config
+}
+
+func serve(config yastatsd.Config) {
+	server, err := yastatsd.New(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	err = server.Start(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	<-sigChan
+
+	log.Print("Shutting down the server")
+	server.Stop()
+}
+
+func captureCommand(args []string) {
+	flags := flag.NewFlagSet(COMMAND_CAPTURE, flag.ExitOnError)
+	path := flags.String("file", DEFAULT_CAPTURE_FILE, "file to record incoming packets to")
+	flags.Parse(args)
+
+	config := mustLoadConfig(CONFIG_FILE)
+	config.CaptureFile = *path
+
+	log.Printf("Capturing incoming packets to %s", *path)
+
+	serve(config)
+}
+
+// Replay doesn't fall back to config.yaml, so captured traffic is never pushed
+// to production backends by accident.
+func replayCommand(args []string) error {
+	flags := flag.NewFlagSet(COMMAND_REPLAY, flag.ExitOnError)
+	path := flags.String("file", DEFAULT_CAPTURE_FILE, "file to replay captured packets from")
+	configPath := flags.String("config", "", "config file for the replay server, must not set stateFile")
+	speed := flags.Float64("speed", 1, "replay speed multiplier, 0 replays as fast as possible")
+	flags.Parse(args)
+
+	if *configPath == "" {
+		return errors.New("Replay config file is required")
+	}
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+
+	if config.StateFile != "" {
+		return errors.New("Replay config must not set stateFile")
+	}
+
+	server, err := yastatsd.New(config)
+	if err != nil {
+		return err
+	}
+
+	defer server.Stop()
+
+	file, err := os.Open(*path)
+	if err != nil {
+		return fmt.Errorf("Error opening capture file: %s", err)
+	}
+
+	defer file.Close()
+
+	err = server.Replay(file, *speed)
+	if err != nil {
+		return fmt.Errorf("Error replaying capture file: %s", err)
+	}
+
+	return nil
+}
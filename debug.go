@@ -1,4 +1,4 @@
-package main
+package yastatsd
 
 import (
 	"bytes"
@@ -83,5 +83,9 @@ func debugPrint(m *metric.CalculatedMetrics) {
 		buf.WriteString(strings.Join(keys, ", ") + "\n")
 	}
 
+	for _, bucket := range util.SortMapKeys(m.SetEstimates) {
+		buf.WriteString(fmt.Sprintf("%s: ~%d unique values\n", bucket, m.SetEstimates[bucket]))
+	}
+
 	log.Print(buf.String())
 }
@@ -0,0 +1,110 @@
+package yastatsd
+
+import (
+	"github.com/evvvvr/yastatsd/internal/metric"
+	"github.com/evvvvr/yastatsd/internal/util"
+)
+
+type flushDocument struct {
+	Timestamp int64                      `json:"timestamp"`
+	Interval  int                        `json:"interval"`
+	Counters  map[string]counterDocument `json:"counters"`
+	Timers    map[string]timerDocument   `json:"timers"`
+	Gauges    map[string]float64         `json:"gauges"`
+	Sets      map[string]uint64          `json:"sets"`
+	Members   map[string][]string        `json:"setMembers,omitempty"`
+}
+
+type counterDocument struct {
+	Value float64 `json:"value"`
+	Rate  float64 `json:"rate"`
+}
+
+type timerDocument struct {
+	Points            []float64                     `json:"points"`
+	Lower             *float64                      `json:"lower,omitempty"`
+	Upper             *float64                      `json:"upper,omitempty"`
+	Count             *float64                      `json:"count,omitempty"`
+	CountPerSecond    *float64                      `json:"countPerSecond,omitempty"`
+	Sum               *float64                      `json:"sum,omitempty"`
+	Mean              *float64                      `json:"mean,omitempty"`
+	Median            *float64                      `json:"median,omitempty"`
+	StandardDeviation *float64                      `json:"standardDeviation,omitempty"`
+	Percentiles       map[string]percentileDocument `json:"percentiles"`
+}
+
+type percentileDocument struct {
+	Count *int     `json:"count,omitempty"`
+	Upper *float64 `json:"upper,omitempty"`
+	Sum   *float64 `json:"sum,omitempty"`
+	Mean  *float64 `json:"mean,omitempty"`
+}
+
+func formatFlushDocument(m *metric.CalculatedMetrics, ts int64, flushInterval int) *flushDocument {
+	doc := flushDocument{Timestamp: ts,
+		Interval: flushInterval,
+		Counters: make(map[string]counterDocument, len(m.Counters)),
+		Timers:   make(map[string]timerDocument, len(m.Timers)),
+		Gauges:   m.Gauges,
+		Sets:     m.SetCounts(),
+		Members:  m.SetMembers}
+
+	if doc.Gauges == nil {
+		doc.Gauges = make(map[string]float64)
+	}
+
+	for bucket, counter := range m.Counters {
+		doc.Counters[bucket] = counterDocument{Value: counter.Value, Rate: counter.Rate}
+	}
+
+	for bucket, timer := range m.Timers {
+		percentiles := make(map[string]percentileDocument, len(timer.PercentilesData))
+
+		for pct, pctData := range timer.PercentilesData {
+			pctDoc := percentileDocument{Upper: percentileField(&timer, metric.PercentileUpper, pctData.Upper),
+				Sum:  percentileField(&timer, metric.PercentileSum, pctData.Sum),
+				Mean: percentileField(&timer, metric.PercentileMean, pctData.Mean)}
+
+			if timer.EmitsPercentile(metric.PercentileCount) {
+				count := pctData.Count
+				pctDoc.Count = &count
+			}
+
+			percentiles[util.FormatFloat(pct)] = pctDoc
+		}
+
+		points := timer.Points
+		if points == nil {
+			points = []float64{}
+		}
+
+		doc.Timers[bucket] = timerDocument{Points: points,
+			Lower:             timerField(&timer, metric.TimerLower, timer.Lower),
+			Upper:             timerField(&timer, metric.TimerUpper, timer.Upper),
+			Count:             timerField(&timer, metric.TimerCount, timer.Count),
+			CountPerSecond:    timerField(&timer, metric.TimerCountPerSecond, timer.CountPerSecond),
+			Sum:               timerField(&timer, metric.TimerSum, timer.Sum),
+			Mean:              timerField(&timer, metric.TimerMean, timer.Mean),
+			Median:            timerField(&timer, metric.TimerMedian, timer.Median),
+			StandardDeviation: timerField(&timer, metric.TimerStandardDeviation, timer.StandardDeviation),
+			Percentiles:       percentiles}
+	}
+
+	return &doc
+}
+
+func timerField(timer *metric.TimerData, field metric.TimerFields, value float64) *float64 {
+	if !timer.Emits(field) {
+		return nil
+	}
+
+	return &value
+}
+
+func percentileField(timer *metric.TimerData, field metric.PercentileFields, value float64) *float64 {
+	if !timer.EmitsPercentile(field) {
+		return nil
+	}
+
+	return &value
+}
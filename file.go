@@ -0,0 +1,200 @@
+package yastatsd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	FILE_FORMAT_JSON     = "json"
+	FILE_FORMAT_GRAPHITE = "graphite"
+	FILE_STDOUT          = "-"
+)
+
+type FileConfig struct {
+	Path           string `yaml:"path"`
+	Format         string `yaml:"format"`
+	MaxSize        int64  `yaml:"maxSize"`
+	RotateInterval int    `yaml:"rotateInterval"`
+	Compress       bool   `yaml:"compress"`
+}
+
+// Rotation is driven by the flush timestamps passed to write, so it follows
+// the server clock. Rotated files are compressed in the background; Close
+// waits for pending compressions.
+type rotatingFile struct {
+	fileConfig   *FileConfig
+	file         *os.File
+	size         int64
+	openedAt     time.Time
+	compressions sync.WaitGroup
+}
+
+func newRotatingFile(fileConfig *FileConfig) (*rotatingFile, error) {
+	f := rotatingFile{fileConfig: fileConfig}
+
+	if fileConfig.Path == FILE_STDOUT {
+		f.file = os.Stdout
+		return &f, nil
+	}
+
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+func flushFile(f *rotatingFile, flushInterval int, periods []periodMetrics, now time.Time) {
+	var buf *bytes.Buffer = bytes.NewBuffer([]byte{})
+
+	for _, p := range periods {
+		ts := p.timestamp.Unix()
+
+		if f.fileConfig.Format == FILE_FORMAT_GRAPHITE {
+			formatGraphiteLines(buf, p.metrics, ts)
+			continue
+		}
+
+		err := json.NewEncoder(buf).Encode(formatFlushDocument(p.metrics, ts, flushInterval))
+		if err != nil {
+			log.Printf("Error encoding metrics for file %s - %s", f.fileConfig.Path, err)
+			return
+		}
+	}
+
+	_, err := f.write(buf.Bytes(), now)
+	if err != nil {
+		log.Printf("Error writing metrics to file %s - %s", f.fileConfig.Path, err)
+	}
+}
+
+func (f *rotatingFile) write(data []byte, now time.Time) (int, error) {
+	if f.shouldRotate(int64(len(data)), now) {
+		err := f.rotate(now)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if f.openedAt.IsZero() {
+		f.openedAt = now
+	}
+
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+
+	return n, err
+}
+
+func (f *rotatingFile) Close() error {
+	f.compressions.Wait()
+
+	if f.file == os.Stdout {
+		return nil
+	}
+
+	return f.file.Close()
+}
+
+func (f *rotatingFile) shouldRotate(writeSize int64, now time.Time) bool {
+	if f.file == os.Stdout || f.size == 0 {
+		return false
+	}
+
+	if f.fileConfig.MaxSize > 0 && f.size+writeSize > f.fileConfig.MaxSize {
+		return true
+	}
+
+	rotateInterval := time.Duration(f.fileConfig.RotateInterval) * time.Millisecond
+
+	return rotateInterval > 0 && !f.openedAt.IsZero() && now.Sub(f.openedAt) >= rotateInterval
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.fileConfig.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.openedAt = time.Time{}
+
+	return nil
+}
+
+func (f *rotatingFile) rotate(now time.Time) error {
+	err := f.file.Close()
+	if err != nil {
+		return err
+	}
+
+	rotatedPath := f.fileConfig.Path + "." + now.Format("20060102T150405.000000000")
+
+	err = os.Rename(f.fileConfig.Path, rotatedPath)
+	if err != nil {
+		return err
+	}
+
+	if f.fileConfig.Compress {
+		f.compressions.Add(1)
+
+		go func() {
+			defer f.compressions.Done()
+
+			err := compressFile(rotatedPath)
+			if err != nil {
+				log.Printf("Error compressing rotated file %s - %s", rotatedPath, err)
+			}
+		}()
+	}
+
+	return f.open()
+}
+
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer src.Close()
+
+	dst, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+
+	gzipWriter := gzip.NewWriter(dst)
+
+	_, err = io.Copy(gzipWriter, src)
+
+	if closeErr := gzipWriter.Close(); err == nil {
+		err = closeErr
+	}
+
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	return os.Remove(path)
+}
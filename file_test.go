@@ -0,0 +1,165 @@
+package yastatsd
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evvvvr/yastatsd/internal/metric"
+)
+
+func TestFlushFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yastatsd")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	fileConfig := FileConfig{Path: filepath.Join(dir, "metrics.log"), Format: FILE_FORMAT_JSON}
+
+	f, err := newRotatingFile(&fileConfig)
+	if err != nil {
+		t.Fatalf("Error opening file: %s", err)
+	}
+
+	defer f.Close()
+
+	m := metric.CalculatedMetrics{Gauges: map[string]float64{"queue": 7}}
+
+	periods := []periodMetrics{{metrics: &m, timestamp: time.Now()}}
+
+	flushFile(f, DEFAULT_FLUSH_INTERVAL_MILLISECONDS, periods, time.Now())
+	flushFile(f, DEFAULT_FLUSH_INTERVAL_MILLISECONDS, periods, time.Now())
+
+	file, err := os.Open(fileConfig.Path)
+	if err != nil {
+		t.Fatalf("Error opening written file: %s", err)
+	}
+
+	defer file.Close()
+
+	var linesCount int
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		var doc flushDocument
+
+		err = json.Unmarshal(scanner.Bytes(), &doc)
+		if err != nil {
+			t.Fatalf("Error decoding line %s: %s", scanner.Text(), err)
+		}
+
+		if doc.Gauges["queue"] != 7 {
+			t.Errorf("Invalid flush document: %+v", doc)
+		}
+
+		linesCount++
+	}
+
+	if linesCount != 2 {
+		t.Errorf("Wrong count of lines. Expected: %d, Actual: %d", 2, linesCount)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yastatsd")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	fileConfig := FileConfig{Path: filepath.Join(dir, "metrics.log"),
+		Format:   FILE_FORMAT_GRAPHITE,
+		MaxSize:  10,
+		Compress: true}
+
+	f, err := newRotatingFile(&fileConfig)
+	if err != nil {
+		t.Fatalf("Error opening file: %s", err)
+	}
+
+	defer f.Close()
+
+	for _, line := range []string{"a 1 1\n", "b 2 1\n"} {
+		_, err = f.write([]byte(line), time.Now())
+		if err != nil {
+			t.Fatalf("Error writing to file: %s", err)
+		}
+	}
+
+	f.compressions.Wait()
+
+	current, _ := ioutil.ReadFile(fileConfig.Path)
+	if string(current) != "b 2 1\n" {
+		t.Errorf("Invalid current file content: %q", current)
+	}
+
+	rotated, _ := filepath.Glob(fileConfig.Path + ".*")
+	if len(rotated) != 1 || !strings.HasSuffix(rotated[0], ".gz") {
+		t.Fatalf("Invalid rotated files: %v", rotated)
+	}
+
+	rotatedFile, err := os.Open(rotated[0])
+	if err != nil {
+		t.Fatalf("Error opening rotated file: %s", err)
+	}
+
+	defer rotatedFile.Close()
+
+	gzipReader, err := gzip.NewReader(rotatedFile)
+	if err != nil {
+		t.Fatalf("Error reading rotated file: %s", err)
+	}
+
+	content, _ := ioutil.ReadAll(gzipReader)
+	if string(content) != "a 1 1\n" {
+		t.Errorf("Invalid rotated file content: %q", content)
+	}
+}
+
+func TestRotatingFileInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yastatsd")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	fileConfig := FileConfig{Path: filepath.Join(dir, "metrics.log"),
+		Format:         FILE_FORMAT_GRAPHITE,
+		RotateInterval: 60000}
+
+	f, err := newRotatingFile(&fileConfig)
+	if err != nil {
+		t.Fatalf("Error opening file: %s", err)
+	}
+
+	defer f.Close()
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i, line := range []string{"a 1 1\n", "b 2 1\n", "c 3 1\n"} {
+		_, err = f.write([]byte(line), start.Add(time.Duration(i)*30*time.Second))
+		if err != nil {
+			t.Fatalf("Error writing to file: %s", err)
+		}
+	}
+
+	rotated, _ := filepath.Glob(fileConfig.Path + ".*")
+	if len(rotated) != 1 || !strings.HasSuffix(rotated[0], ".20200101T000100.000000000") {
+		t.Fatalf("File must be rotated by flush time. Rotated files: %v", rotated)
+	}
+
+	current, _ := ioutil.ReadFile(fileConfig.Path)
+	if string(current) != "c 3 1\n" {
+		t.Errorf("Invalid current file content: %q", current)
+	}
+}
@@ -1,10 +1,11 @@
-package main
+package yastatsd
 
 import (
 	"bytes"
 	"fmt"
 	"log"
 	"net"
+	"sort"
 	"strings"
 	"time"
 
@@ -12,63 +13,11 @@ import (
 	"github.com/evvvvr/yastatsd/internal/util"
 )
 
-func flushMetrics(deadline time.Duration, m *metric.CalculatedMetrics, graphiteIPV6 bool, graphiteAddress string) {
+func flushMetrics(deadline time.Duration, periods []periodMetrics, graphiteIPV6 bool, graphiteAddress string) {
 	var buf *bytes.Buffer = bytes.NewBuffer([]byte{})
-	ts := time.Now().Unix()
 
-	for bucket, counter := range m.Counters {
-		valStr := util.FormatFloat(counter.Value)
-		rateStr := util.FormatFloat(counter.Rate)
-		fmt.Fprintf(buf, "%s.count %s %d\n", bucket, valStr, ts)
-		fmt.Fprintf(buf, "%s.rate %s %d\n", bucket, rateStr, ts)
-	}
-
-	for bucket, timer := range m.Timers {
-		lowerStr := util.FormatFloat(timer.Lower)
-		upperStr := util.FormatFloat(timer.Upper)
-		countStr := util.FormatFloat(timer.Count)
-		countPsStr := util.FormatFloat(timer.CountPerSecond)
-		sumStr := util.FormatFloat(timer.Sum)
-		meanStr := util.FormatFloat(timer.Mean)
-		medianStr := util.FormatFloat(timer.Median)
-		stdStr := util.FormatFloat(timer.StandardDeviation)
-
-		fmt.Fprintf(buf, "%s.lower %s %d\n", bucket, lowerStr, ts)
-		fmt.Fprintf(buf, "%s.upper %s %d\n", bucket, upperStr, ts)
-		fmt.Fprintf(buf, "%s.count %s %d\n", bucket, countStr, ts)
-		fmt.Fprintf(buf, "%s.count_ps %s %d\n", bucket, countPsStr, ts)
-		fmt.Fprintf(buf, "%s.sum %s %d\n", bucket, sumStr, ts)
-		fmt.Fprintf(buf, "%s.mean %s %d\n", bucket, meanStr, ts)
-		fmt.Fprintf(buf, "%s.median %s %d\n", bucket, medianStr, ts)
-		fmt.Fprintf(buf, "%s.std %s %d\n", bucket, stdStr, ts)
-
-		for pct, pctData := range timer.PercentilesData {
-			pctStr := util.FormatFloat(pct)
-			pctStr = strings.Replace(strings.Replace(pctStr, ".", "_", -1), "-", "top", -1)
-			upperStr := util.FormatFloat(pctData.Upper)
-			sumStr := util.FormatFloat(pctData.Sum)
-			meanStr := util.FormatFloat(pctData.Mean)
-
-			fmt.Fprintf(buf, "%s.count_%s %d %d\n", bucket, pctStr, pctData.Count, ts)
-
-			if util.CmpToZero(pct) > 0 {
-				fmt.Fprintf(buf, "%s.upper_%s %s %d\n", bucket, pctStr, upperStr, ts)
-			} else {
-				fmt.Fprintf(buf, "%s.lower_%s %s %d\n", bucket, pctStr, upperStr, ts)
-			}
-
-			fmt.Fprintf(buf, "%s.sum_%s %s %d\n", bucket, pctStr, sumStr, ts)
-			fmt.Fprintf(buf, "%s.mean_%s %s %d\n", bucket, pctStr, meanStr, ts)
-		}
-	}
-
-	for bucket, gauge := range m.Gauges {
-		valStr := util.FormatFloat(gauge)
-		fmt.Fprintf(buf, "%s %s %d\n", bucket, valStr, ts)
-	}
-
-	for bucket, set := range m.Sets {
-		fmt.Fprintf(buf, "%s %d %d\n", bucket, len(set), ts)
+	for _, p := range periods {
+		formatGraphiteLines(buf, p.metrics, p.timestamp.Unix())
 	}
 
 	network := "tcp"
@@ -96,3 +45,90 @@ func flushMetrics(deadline time.Duration, m *metric.CalculatedMetrics, graphiteI
 		return
 	}
 }
+
+func formatGraphiteLines(buf *bytes.Buffer, m *metric.CalculatedMetrics, ts int64) {
+	for _, bucket := range util.SortMapKeys(m.Counters) {
+		counter := m.Counters[bucket]
+		valStr := util.FormatFloat(counter.Value)
+		rateStr := util.FormatFloat(counter.Rate)
+		fmt.Fprintf(buf, "%s %s %d\n", graphiteName(bucket, "count"), valStr, ts)
+		fmt.Fprintf(buf, "%s %s %d\n", graphiteName(bucket, "rate"), rateStr, ts)
+	}
+
+	for _, bucket := range util.SortMapKeys(m.Timers) {
+		timer := m.Timers[bucket]
+
+		for _, value := range timer.Values() {
+			fmt.Fprintf(buf, "%s %s %d\n", graphiteName(bucket, value.Name), util.FormatFloat(value.Value), ts)
+		}
+
+		for _, pct := range sortPercentiles(timer.PercentilesData) {
+			pctData := timer.PercentilesData[pct]
+			pctStr := formatPercentile(pct)
+			upperStr := util.FormatFloat(pctData.Upper)
+			sumStr := util.FormatFloat(pctData.Sum)
+			meanStr := util.FormatFloat(pctData.Mean)
+
+			if timer.EmitsPercentile(metric.PercentileCount) {
+				fmt.Fprintf(buf, "%s %d %d\n", graphiteName(bucket, "count_"+pctStr), pctData.Count, ts)
+			}
+
+			if timer.EmitsPercentile(metric.PercentileUpper) {
+				if util.CmpToZero(pct) > 0 {
+					fmt.Fprintf(buf, "%s %s %d\n", graphiteName(bucket, "upper_"+pctStr), upperStr, ts)
+				} else {
+					fmt.Fprintf(buf, "%s %s %d\n", graphiteName(bucket, "lower_"+pctStr), upperStr, ts)
+				}
+			}
+
+			if timer.EmitsPercentile(metric.PercentileSum) {
+				fmt.Fprintf(buf, "%s %s %d\n", graphiteName(bucket, "sum_"+pctStr), sumStr, ts)
+			}
+
+			if timer.EmitsPercentile(metric.PercentileMean) {
+				fmt.Fprintf(buf, "%s %s %d\n", graphiteName(bucket, "mean_"+pctStr), meanStr, ts)
+			}
+		}
+	}
+
+	for _, bucket := range util.SortMapKeys(m.Gauges) {
+		gauge := m.Gauges[bucket]
+		valStr := util.FormatFloat(gauge)
+		fmt.Fprintf(buf, "%s %s %d\n", bucket, valStr, ts)
+	}
+
+	setCounts := m.SetCounts()
+
+	for _, bucket := range util.SortMapKeys(setCounts) {
+		fmt.Fprintf(buf, "%s %d %d\n", bucket, setCounts[bucket], ts)
+	}
+}
+
+// Graphite tags follow the full metric path, so suffixes go before them.
+func graphiteName(bucket string, suffix string) string {
+	i := strings.IndexByte(bucket, ';')
+
+	if i < 0 {
+		return bucket + "." + suffix
+	}
+
+	return bucket[:i] + "." + suffix + bucket[i:]
+}
+
+func formatPercentile(pct float64) string {
+	pctStr := util.FormatFloat(pct)
+
+	return strings.Replace(strings.Replace(pctStr, ".", "_", -1), "-", "top", -1)
+}
+
+func sortPercentiles(percentilesData map[float64]metric.PercentileData) []float64 {
+	percentiles := make([]float64, 0, len(percentilesData))
+
+	for pct := range percentilesData {
+		percentiles = append(percentiles, pct)
+	}
+
+	sort.Float64s(percentiles)
+
+	return percentiles
+}
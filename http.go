@@ -0,0 +1,35 @@
+package yastatsd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+func postHTTP(client *http.Client, url string, headers map[string]string, body io.Reader) error {
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Unexpected status %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package yastatsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/evvvvr/yastatsd/internal/metric"
+)
+
+const DEFAULT_HTTP_RETRY_DELAY_MILLISECONDS = 1000
+
+type HTTPConfig struct {
+	Address    string            `yaml:"address"`
+	Headers    map[string]string `yaml:"headers"`
+	Timeout    int               `yaml:"timeout"`
+	Retries    int               `yaml:"retries"`
+	RetryDelay int               `yaml:"retryDelay"`
+}
+
+func flushHTTP(flushInterval int, m *metric.CalculatedMetrics, now time.Time, httpConfig *HTTPConfig) {
+	doc := formatFlushDocument(m, now.Unix(), flushInterval)
+
+	body, err := json.Marshal(doc)
+	if err != nil {
+		log.Printf("Error encoding metrics for HTTP endpoint %s - %s", httpConfig.Address, err)
+		return
+	}
+
+	headers := map[string]string{"Content-Type": "application/json"}
+	for k, v := range httpConfig.Headers {
+		headers[k] = v
+	}
+
+	// Retries must not delay the next flush, so all attempts share a budget of
+	// one flush interval.
+	deadline := time.Now().Add(time.Duration(flushInterval) * time.Millisecond)
+
+	timeout := time.Duration(httpConfig.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = time.Duration(flushInterval) * time.Millisecond
+	}
+
+	retryDelay := time.Duration(httpConfig.RetryDelay) * time.Millisecond
+	if retryDelay <= 0 {
+		retryDelay = DEFAULT_HTTP_RETRY_DELAY_MILLISECONDS * time.Millisecond
+	}
+
+	client := &http.Client{}
+
+	for attempt := 0; ; attempt++ {
+		client.Timeout = timeout
+		if remaining := time.Until(deadline); remaining < timeout {
+			client.Timeout = remaining
+		}
+
+		err = postHTTP(client, httpConfig.Address, headers, bytes.NewReader(body))
+		if err == nil {
+			return
+		}
+
+		if attempt >= httpConfig.Retries || time.Until(deadline) <= retryDelay {
+			break
+		}
+
+		log.Printf("Error submitting metrics to HTTP endpoint %s, retrying - %s", httpConfig.Address, err)
+		time.Sleep(retryDelay)
+	}
+
+	log.Printf("Error submitting metrics to HTTP endpoint %s - %s", httpConfig.Address, err)
+}
@@ -0,0 +1,89 @@
+package yastatsd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/evvvvr/yastatsd/internal/metric"
+)
+
+func TestFlushHTTP(t *testing.T) {
+	var requestsCount int
+	var doc flushDocument
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestsCount++
+
+		if requestsCount == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Invalid authorization header: %s", r.Header.Get("Authorization"))
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&doc)
+		if err != nil {
+			t.Errorf("Error decoding request: %s", err)
+		}
+	}))
+
+	defer server.Close()
+
+	m := metric.CalculatedMetrics{
+		Counters: map[string]metric.CounterData{"hits": {Value: 10, Rate: 1}},
+		Timers: map[string]metric.TimerData{"latency": {Points: []float64{1, 3}, Lower: 1, Upper: 3, Mean: 2,
+			PercentilesData: map[float64]metric.PercentileData{99.9: {Count: 2, Upper: 3, Sum: 4, Mean: 2}}}},
+		Gauges:     map[string]float64{"queue": 7},
+		Sets:       map[string]map[string]struct{}{"users": {"a": {}, "b": {}}},
+		SetMembers: map[string][]string{"users": {"a", "b"}}}
+
+	httpConfig := HTTPConfig{Address: server.URL,
+		Headers:    map[string]string{"Authorization": "Bearer token"},
+		Retries:    1,
+		RetryDelay: 1}
+
+	flushHTTP(DEFAULT_FLUSH_INTERVAL_MILLISECONDS, &m, time.Now(), &httpConfig)
+
+	if requestsCount != 2 {
+		t.Fatalf("Wrong count of requests. Expected: %d, Actual: %d", 2, requestsCount)
+	}
+
+	if doc.Interval != DEFAULT_FLUSH_INTERVAL_MILLISECONDS || doc.Counters["hits"].Value != 10 || doc.Gauges["queue"] != 7 ||
+		doc.Sets["users"] != 2 || len(doc.Members["users"]) != 2 {
+		t.Errorf("Invalid flush document: %+v", doc)
+	}
+
+	if *doc.Timers["latency"].Mean != 2 || *doc.Timers["latency"].Percentiles["99.9"].Sum != 4 {
+		t.Errorf("Invalid timer document: %+v", doc.Timers["latency"])
+	}
+}
+
+func TestFlushHTTPRetryBudget(t *testing.T) {
+	var requestsCount int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requestsCount, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+
+	defer server.Close()
+
+	httpConfig := HTTPConfig{Address: server.URL, Retries: 100, RetryDelay: 50}
+	start := time.Now()
+
+	flushHTTP(200, &metric.CalculatedMetrics{}, start, &httpConfig)
+
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Errorf("Retries must finish within the flush interval. Actual: %s", elapsed)
+	}
+
+	if count := atomic.LoadInt32(&requestsCount); count < 2 || count > 4 {
+		t.Errorf("Wrong count of requests. Expected: 2-4, Actual: %d", count)
+	}
+}
@@ -0,0 +1,184 @@
+package yastatsd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/evvvvr/yastatsd/internal/bucket"
+	"github.com/evvvvr/yastatsd/internal/metric"
+	"github.com/evvvvr/yastatsd/internal/util"
+)
+
+const DEFAULT_INFLUXDB_BATCH_SIZE = 5000
+
+type InfluxDBConfig struct {
+	Address   string `yaml:"address"`
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password"`
+	Token     string `yaml:"token"`
+	BatchSize int    `yaml:"batchSize"`
+	Gzip      bool   `yaml:"gzip"`
+}
+
+var (
+	influxDBMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxDBTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+func flushInfluxDB(deadline time.Duration, periods []periodMetrics, influxDBConfig *InfluxDBConfig) {
+	var lines []string
+
+	for _, p := range periods {
+		lines = append(lines, formatInfluxDBLines(p.metrics, p.timestamp)...)
+	}
+	client := &http.Client{Timeout: deadline}
+
+	batchSize := influxDBConfig.BatchSize
+	if batchSize <= 0 {
+		batchSize = DEFAULT_INFLUXDB_BATCH_SIZE
+	}
+
+	for start := 0; start < len(lines); start += batchSize {
+		end := start + batchSize
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		err := postInfluxDB(client, influxDBConfig, lines[start:end])
+		if err != nil {
+			log.Printf("Error submitting metrics to InfluxDB server %s - %s", influxDBConfig.Address, err)
+			return
+		}
+	}
+}
+
+func formatInfluxDBLines(m *metric.CalculatedMetrics, t time.Time) []string {
+	ts := t.UnixNano()
+	lines := make([]string, 0, len(m.Counters)+len(m.Timers)+len(m.Gauges)+len(m.Sets)+len(m.SetEstimates))
+
+	for _, b := range util.SortMapKeys(m.Counters) {
+		counter := m.Counters[b]
+
+		lines = append(lines, formatInfluxDBLine(b, ts,
+			"value", util.FormatFloat(counter.Value),
+			"rate", util.FormatFloat(counter.Rate)))
+	}
+
+	for _, b := range util.SortMapKeys(m.Timers) {
+		timer := m.Timers[b]
+		var fields []string
+
+		for _, value := range timer.Values() {
+			fields = append(fields, value.Name, util.FormatFloat(value.Value))
+		}
+
+		for _, pct := range sortPercentiles(timer.PercentilesData) {
+			pctData := timer.PercentilesData[pct]
+			pctStr := formatPercentile(pct)
+
+			limitName := "upper_"
+			if util.CmpToZero(pct) < 0 {
+				limitName = "lower_"
+			}
+
+			if timer.EmitsPercentile(metric.PercentileCount) {
+				fields = append(fields, "count_"+pctStr, fmt.Sprintf("%d", pctData.Count))
+			}
+
+			if timer.EmitsPercentile(metric.PercentileUpper) {
+				fields = append(fields, limitName+pctStr, util.FormatFloat(pctData.Upper))
+			}
+
+			if timer.EmitsPercentile(metric.PercentileSum) {
+				fields = append(fields, "sum_"+pctStr, util.FormatFloat(pctData.Sum))
+			}
+
+			if timer.EmitsPercentile(metric.PercentileMean) {
+				fields = append(fields, "mean_"+pctStr, util.FormatFloat(pctData.Mean))
+			}
+		}
+
+		if len(fields) > 0 {
+			lines = append(lines, formatInfluxDBLine(b, ts, fields...))
+		}
+	}
+
+	for _, b := range util.SortMapKeys(m.Gauges) {
+		lines = append(lines, formatInfluxDBLine(b, ts, "value", util.FormatFloat(m.Gauges[b])))
+	}
+
+	setCounts := m.SetCounts()
+
+	for _, b := range util.SortMapKeys(setCounts) {
+		lines = append(lines, formatInfluxDBLine(b, ts, "count", fmt.Sprintf("%d", setCounts[b])))
+	}
+
+	return lines
+}
+
+func formatInfluxDBLine(b string, ts int64, fields ...string) string {
+	name, tags := bucket.SplitTags(b)
+	buf := bytes.NewBufferString(influxDBMeasurementEscaper.Replace(name))
+
+	for _, k := range util.SortMapKeys(tags) {
+		fmt.Fprintf(buf, ",%s=%s", influxDBTagEscaper.Replace(k), influxDBTagEscaper.Replace(tags[k]))
+	}
+
+	for i := 0; i < len(fields); i += 2 {
+		separator := ","
+		if i == 0 {
+			separator = " "
+		}
+
+		fmt.Fprintf(buf, "%s%s=%s", separator, influxDBTagEscaper.Replace(fields[i]), fields[i+1])
+	}
+
+	fmt.Fprintf(buf, " %d", ts)
+
+	return buf.String()
+}
+
+func postInfluxDB(client *http.Client, influxDBConfig *InfluxDBConfig, lines []string) error {
+	var body bytes.Buffer
+	var w io.Writer = &body
+	var gzipWriter *gzip.Writer
+
+	if influxDBConfig.Gzip {
+		gzipWriter = gzip.NewWriter(&body)
+		w = gzipWriter
+	}
+
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	if err != nil {
+		return err
+	}
+
+	if gzipWriter != nil {
+		err = gzipWriter.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	headers := map[string]string{"Content-Type": "text/plain; charset=utf-8"}
+
+	if influxDBConfig.Gzip {
+		headers["Content-Encoding"] = "gzip"
+	}
+
+	if influxDBConfig.Token != "" {
+		headers["Authorization"] = "Token " + influxDBConfig.Token
+	} else if influxDBConfig.Username != "" {
+		credentials := influxDBConfig.Username + ":" + influxDBConfig.Password
+		headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+
+	return postHTTP(client, influxDBConfig.Address, headers, &body)
+}
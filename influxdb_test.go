@@ -0,0 +1,78 @@
+package yastatsd
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evvvvr/yastatsd/internal/metric"
+)
+
+func TestFormatInfluxDBLines(t *testing.T) {
+	m := metric.CalculatedMetrics{
+		Counters: map[string]metric.CounterData{"statsd.hits;host=web 1": {Value: 10, Rate: 1}},
+		Timers: map[string]metric.TimerData{"statsd.latency": {Points: []float64{1}, Lower: 1, Upper: 1,
+			Count: 1, CountPerSecond: 0.1, Sum: 1, Mean: 1, Median: 1,
+			PercentilesData: map[float64]metric.PercentileData{90: {Count: 1, Upper: 1, Sum: 1, Mean: 1}}}},
+		Gauges: map[string]float64{"statsd.queue": -3},
+		Sets:   map[string]map[string]struct{}{"statsd.users": {"a": {}, "b": {}}}}
+
+	expectedLines := []string{
+		`statsd.hits,host=web\ 1 value=10,rate=1 1000000000`,
+		"statsd.latency lower=1,upper=1,count=1,count_ps=0.1,sum=1,mean=1,median=1,std=0," +
+			"count_90=1,upper_90=1,sum_90=1,mean_90=1 1000000000",
+		"statsd.queue value=-3 1000000000",
+		"statsd.users count=2 1000000000"}
+
+	lines := formatInfluxDBLines(&m, time.Unix(1, 0))
+
+	if len(lines) != len(expectedLines) {
+		t.Fatalf("Wrong count of lines. Expected: %d, Actual: %d", len(expectedLines), len(lines))
+	}
+
+	for i, line := range lines {
+		if line != expectedLines[i] {
+			t.Errorf("Invalid line. Expected: %s, Actual: %s", expectedLines[i], line)
+		}
+	}
+}
+
+func TestFlushInfluxDB(t *testing.T) {
+	var requests []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token secret" {
+			t.Errorf("Invalid authorization header: %s", r.Header.Get("Authorization"))
+		}
+
+		body, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("Error reading gzipped body: %s", err)
+			return
+		}
+
+		data, _ := ioutil.ReadAll(body)
+		requests = append(requests, string(data))
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	defer server.Close()
+
+	m := metric.CalculatedMetrics{Gauges: map[string]float64{"a": 1, "b": 2, "c": 3}}
+	influxDBConfig := InfluxDBConfig{Address: server.URL, Token: "secret", BatchSize: 2, Gzip: true}
+
+	flushInfluxDB(time.Second, []periodMetrics{{metrics: &m, timestamp: time.Now()}}, &influxDBConfig)
+
+	if len(requests) != 2 {
+		t.Fatalf("Wrong count of requests. Expected: %d, Actual: %d", 2, len(requests))
+	}
+
+	if strings.Count(requests[0], "\n") != 2 || !strings.HasPrefix(requests[1], "c value=3 ") {
+		t.Errorf("Invalid batches: %q", requests)
+	}
+}
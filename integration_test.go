@@ -0,0 +1,626 @@
+package yastatsd
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	w := fakeWaiter{at: c.now.Add(d), c: make(chan time.Time, 1)}
+
+	if d <= 0 {
+		w.c <- c.now
+	} else {
+		c.waiters = append(c.waiters, w)
+	}
+
+	return w.c
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+
+	var pending []fakeWaiter
+
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			pending = append(pending, w)
+		} else {
+			w.c <- c.now
+		}
+	}
+
+	c.waiters = pending
+}
+
+type testHarness struct {
+	t        *testing.T
+	clock    *fakeClock
+	server   *Server
+	graphite net.Listener
+	interval time.Duration
+}
+
+func newTestHarness(t *testing.T, start time.Time, configure func(*Config)) *testHarness {
+	graphite, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening TCP: %s", err)
+	}
+
+	config := DefaultConfig()
+	config.UdpServerAddress = ""
+	config.GraphiteAddress = graphite.Addr().String()
+
+	if configure != nil {
+		configure(&config)
+	}
+
+	server, err := New(config)
+	if err != nil {
+		graphite.Close()
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	h := &testHarness{t: t, clock: newFakeClock(start), server: server, graphite: graphite,
+		interval: time.Duration(config.FlushInterval) * time.Millisecond}
+	server.clock = h.clock
+
+	err = server.Start(context.Background())
+	if err != nil {
+		graphite.Close()
+		t.Fatalf("Error starting server: %s", err)
+	}
+
+	return h
+}
+
+func (h *testHarness) Close() {
+	h.server.Stop()
+	h.graphite.Close()
+}
+
+func (h *testHarness) Send(packet string) {
+	h.server.HandlePacket([]byte(packet))
+}
+
+func (h *testHarness) Flush() string {
+	return h.FlushAfter(h.interval)
+}
+
+func (h *testHarness) FlushAfter(d time.Duration) string {
+	h.clock.Advance(d)
+
+	return h.Read()
+}
+
+func (h *testHarness) Read() string {
+	h.graphite.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn, err := h.graphite.Accept()
+	if err != nil {
+		h.t.Fatalf("Error accepting Graphite connection: %s", err)
+	}
+
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	data, err := ioutil.ReadAll(conn)
+	if err != nil {
+		h.t.Fatalf("Error reading Graphite data: %s", err)
+	}
+
+	return string(data)
+}
+
+func TestUDPIntegration(t *testing.T) {
+	h := newTestHarness(t, time.Unix(1500000000, 0), func(config *Config) {
+		config.UdpServerAddress = "127.0.0.1:0"
+		config.FlushInterval = 1000
+	})
+
+	defer h.Close()
+
+	conn, err := net.Dial("udp", h.server.UDPAddr().String())
+	if err != nil {
+		t.Fatalf("Error connecting UDP: %s", err)
+	}
+
+	defer conn.Close()
+
+	conn.Write([]byte("hits:2|c\nhits:1|c\nqueue:5|g"))
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for h.server.Snapshot().Gauges["statsd.queue"] != 5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	actual := h.Flush()
+
+	for _, line := range []string{"statsd.hits.count 3 1500000001",
+		"statsd.packets_recieved.count 1 1500000001", "statsd.metrics_recieved.count 3 1500000001",
+		"statsd.queue 5 1500000001"} {
+		if !strings.Contains(actual, line+"\n") {
+			t.Errorf("Graphite output must contain %q. Actual:\n%s", line, actual)
+		}
+	}
+}
+
+func TestGraphiteTagsIntegration(t *testing.T) {
+	h := newTestHarness(t, time.Unix(1500000000, 0), func(config *Config) {
+		config.FlushInterval = 1000
+	})
+
+	defer h.Close()
+
+	h.Send("hits:1|c|#env:prod\nlatency:5|ms|#env:prod,host:a")
+
+	actual := h.Flush()
+
+	for _, line := range []string{"statsd.hits.count;env=prod 1 1500000001", "statsd.hits.rate;env=prod 1 1500000001",
+		"statsd.latency.upper;env=prod;host=a 5 1500000001", "statsd.latency.count;env=prod;host=a 1 1500000001"} {
+		if !strings.Contains(actual, line+"\n") {
+			t.Errorf("Graphite output must contain %q. Actual:\n%s", line, actual)
+		}
+	}
+}
+
+func TestGraphiteIntegration(t *testing.T) {
+	h := newTestHarness(t, time.Unix(1500000000, 0), func(config *Config) {
+		config.FlushInterval = 1000
+		config.Percentiles = []float64{50}
+	})
+
+	defer h.Close()
+
+	h.Send("hits:2|c\nhits:1|c|@0.5\nlatency:10|ms\nlatency:30|ms")
+	h.Send("queue:5|g\nusers:bob|s\nusers:alice|s\nbad")
+
+	expected := `statsd.bad_lines_seen.count 1 1500000001
+statsd.bad_lines_seen.rate 1 1500000001
+statsd.bad_sampling_rates.count 0 1500000001
+statsd.bad_sampling_rates.rate 0 1500000001
+statsd.buckets_overflowed.count 0 1500000001
+statsd.buckets_overflowed.rate 0 1500000001
+statsd.buckets_rejected.count 0 1500000001
+statsd.buckets_rejected.rate 0 1500000001
+statsd.hits.count 4 1500000001
+statsd.hits.rate 4 1500000001
+statsd.metrics_dropped.count 0 1500000001
+statsd.metrics_dropped.rate 0 1500000001
+statsd.metrics_recieved.count 7 1500000001
+statsd.metrics_recieved.rate 7 1500000001
+statsd.metrics_too_old.count 0 1500000001
+statsd.metrics_too_old.rate 0 1500000001
+statsd.packets_recieved.count 2 1500000001
+statsd.packets_recieved.rate 2 1500000001
+statsd.latency.lower 10 1500000001
+statsd.latency.upper 30 1500000001
+statsd.latency.count 2 1500000001
+statsd.latency.count_ps 2 1500000001
+statsd.latency.sum 40 1500000001
+statsd.latency.mean 20 1500000001
+statsd.latency.median 20 1500000001
+statsd.latency.std 10 1500000001
+statsd.latency.count_50 1 1500000001
+statsd.latency.upper_50 10 1500000001
+statsd.latency.sum_50 10 1500000001
+statsd.latency.mean_50 10 1500000001
+statsd.queue 5 1500000001
+statsd.users 2 1500000001
+`
+
+	actual := h.Flush()
+	if actual != expected {
+		t.Errorf("Wrong Graphite output. Expected:\n%s\nActual:\n%s", expected, actual)
+	}
+
+	h.Send("hits:1|c")
+
+	expected = `statsd.bad_lines_seen.count 0 1500000002
+statsd.bad_lines_seen.rate 0 1500000002
+statsd.bad_sampling_rates.count 0 1500000002
+statsd.bad_sampling_rates.rate 0 1500000002
+statsd.buckets_overflowed.count 0 1500000002
+statsd.buckets_overflowed.rate 0 1500000002
+statsd.buckets_rejected.count 0 1500000002
+statsd.buckets_rejected.rate 0 1500000002
+statsd.hits.count 1 1500000002
+statsd.hits.rate 1 1500000002
+statsd.metrics_dropped.count 0 1500000002
+statsd.metrics_dropped.rate 0 1500000002
+statsd.metrics_recieved.count 1 1500000002
+statsd.metrics_recieved.rate 1 1500000002
+statsd.metrics_too_old.count 0 1500000002
+statsd.metrics_too_old.rate 0 1500000002
+statsd.packets_recieved.count 1 1500000002
+statsd.packets_recieved.rate 1 1500000002
+statsd.latency.lower 0 1500000002
+statsd.latency.upper 0 1500000002
+statsd.latency.count 0 1500000002
+statsd.latency.count_ps 0 1500000002
+statsd.latency.sum 0 1500000002
+statsd.latency.mean 0 1500000002
+statsd.latency.median 0 1500000002
+statsd.latency.std 0 1500000002
+statsd.queue 5 1500000002
+statsd.users 0 1500000002
+`
+
+	actual = h.Flush()
+	if actual != expected {
+		t.Errorf("Wrong Graphite output. Expected:\n%s\nActual:\n%s", expected, actual)
+	}
+}
+
+func TestAlignedFlushIntegration(t *testing.T) {
+	h := newTestHarness(t, time.Unix(1500000000, 400000000), func(config *Config) {
+		config.FlushInterval = 1000
+		config.AlignFlushes = true
+	})
+
+	defer h.Close()
+
+	h.Send("hits:1|c")
+
+	expected := `statsd.bad_lines_seen.count 0 1500000000
+statsd.bad_lines_seen.rate 0 1500000000
+statsd.bad_sampling_rates.count 0 1500000000
+statsd.bad_sampling_rates.rate 0 1500000000
+statsd.buckets_overflowed.count 0 1500000000
+statsd.buckets_overflowed.rate 0 1500000000
+statsd.buckets_rejected.count 0 1500000000
+statsd.buckets_rejected.rate 0 1500000000
+statsd.hits.count 1 1500000000
+statsd.hits.rate 1 1500000000
+statsd.metrics_dropped.count 0 1500000000
+statsd.metrics_dropped.rate 0 1500000000
+statsd.metrics_recieved.count 1 1500000000
+statsd.metrics_recieved.rate 1 1500000000
+statsd.metrics_too_old.count 0 1500000000
+statsd.metrics_too_old.rate 0 1500000000
+statsd.packets_recieved.count 1 1500000000
+statsd.packets_recieved.rate 1 1500000000
+`
+
+	actual := h.FlushAfter(600 * time.Millisecond)
+	if actual != expected {
+		t.Errorf("Wrong Graphite output. Expected:\n%s\nActual:\n%s", expected, actual)
+	}
+
+	h.Send("hits:2|c")
+
+	expected = `statsd.bad_lines_seen.count 0 1500000001
+statsd.bad_lines_seen.rate 0 1500000001
+statsd.bad_sampling_rates.count 0 1500000001
+statsd.bad_sampling_rates.rate 0 1500000001
+statsd.buckets_overflowed.count 0 1500000001
+statsd.buckets_overflowed.rate 0 1500000001
+statsd.buckets_rejected.count 0 1500000001
+statsd.buckets_rejected.rate 0 1500000001
+statsd.hits.count 2 1500000001
+statsd.hits.rate 2 1500000001
+statsd.metrics_dropped.count 0 1500000001
+statsd.metrics_dropped.rate 0 1500000001
+statsd.metrics_recieved.count 1 1500000001
+statsd.metrics_recieved.rate 1 1500000001
+statsd.metrics_too_old.count 0 1500000001
+statsd.metrics_too_old.rate 0 1500000001
+statsd.packets_recieved.count 1 1500000001
+statsd.packets_recieved.rate 1 1500000001
+`
+
+	actual = h.Flush()
+	if actual != expected {
+		t.Errorf("Wrong Graphite output. Expected:\n%s\nActual:\n%s", expected, actual)
+	}
+}
+
+func TestBackfillIntegration(t *testing.T) {
+	h := newTestHarness(t, time.Unix(1500000000, 0), func(config *Config) {
+		config.FlushInterval = 1000
+	})
+
+	defer h.Close()
+
+	h.Send("hits:2|c\nhits:3|c|T1499999990\nhits:4|c|T1499999990\nhits:5|c|T1500000000")
+	h.Send("hits:1|c|T1499999995\nhits:9|c|T1499990000")
+
+	expected := `statsd.bad_lines_seen.count 0 1500000001
+statsd.bad_lines_seen.rate 0 1500000001
+statsd.bad_sampling_rates.count 0 1500000001
+statsd.bad_sampling_rates.rate 0 1500000001
+statsd.buckets_overflowed.count 0 1500000001
+statsd.buckets_overflowed.rate 0 1500000001
+statsd.buckets_rejected.count 0 1500000001
+statsd.buckets_rejected.rate 0 1500000001
+statsd.hits.count 7 1500000001
+statsd.hits.rate 7 1500000001
+statsd.metrics_dropped.count 0 1500000001
+statsd.metrics_dropped.rate 0 1500000001
+statsd.metrics_recieved.count 6 1500000001
+statsd.metrics_recieved.rate 6 1500000001
+statsd.metrics_too_old.count 1 1500000001
+statsd.metrics_too_old.rate 1 1500000001
+statsd.packets_recieved.count 2 1500000001
+statsd.packets_recieved.rate 2 1500000001
+`
+
+	actual := h.Flush()
+	if actual != expected {
+		t.Errorf("Wrong Graphite output. Expected:\n%s\nActual:\n%s", expected, actual)
+	}
+
+	expected = `statsd.hits.count 7 1499999990
+statsd.hits.rate 7 1499999990
+statsd.hits.count 1 1499999995
+statsd.hits.rate 1 1499999995
+`
+
+	actual = h.Read()
+	if actual != expected {
+		t.Errorf("Wrong backfilled Graphite output. Expected:\n%s\nActual:\n%s", expected, actual)
+	}
+}
+
+func TestTimerOverridesIntegration(t *testing.T) {
+	h := newTestHarness(t, time.Unix(1500000000, 0), func(config *Config) {
+		config.FlushInterval = 1000
+		config.Percentiles = []float64{50}
+		config.TimerOverrides = []TimerOverride{
+			{Match: "statsd.jobs.*", Percentiles: []float64{}, Fields: []string{"mean"}},
+			{Regex: "^statsd\\.api$", Percentiles: []float64{99, 99.9}, Fields: []string{"count", "upper"}},
+		}
+	})
+
+	defer h.Close()
+
+	h.Send("api:10|ms\napi:30|ms\njobs.import:4|ms\njobs.import:8|ms\nlatency:5|ms")
+
+	expected := `statsd.bad_lines_seen.count 0 1500000001
+statsd.bad_lines_seen.rate 0 1500000001
+statsd.bad_sampling_rates.count 0 1500000001
+statsd.bad_sampling_rates.rate 0 1500000001
+statsd.buckets_overflowed.count 0 1500000001
+statsd.buckets_overflowed.rate 0 1500000001
+statsd.buckets_rejected.count 0 1500000001
+statsd.buckets_rejected.rate 0 1500000001
+statsd.metrics_dropped.count 0 1500000001
+statsd.metrics_dropped.rate 0 1500000001
+statsd.metrics_recieved.count 5 1500000001
+statsd.metrics_recieved.rate 5 1500000001
+statsd.metrics_too_old.count 0 1500000001
+statsd.metrics_too_old.rate 0 1500000001
+statsd.packets_recieved.count 1 1500000001
+statsd.packets_recieved.rate 1 1500000001
+statsd.api.upper 30 1500000001
+statsd.api.count 2 1500000001
+statsd.api.count_99 2 1500000001
+statsd.api.upper_99 30 1500000001
+statsd.api.sum_99 40 1500000001
+statsd.api.mean_99 20 1500000001
+statsd.api.count_99_9 2 1500000001
+statsd.api.upper_99_9 30 1500000001
+statsd.api.sum_99_9 40 1500000001
+statsd.api.mean_99_9 20 1500000001
+statsd.jobs.import.mean 6 1500000001
+statsd.latency.lower 5 1500000001
+statsd.latency.upper 5 1500000001
+statsd.latency.count 1 1500000001
+statsd.latency.count_ps 1 1500000001
+statsd.latency.sum 5 1500000001
+statsd.latency.mean 5 1500000001
+statsd.latency.median 5 1500000001
+statsd.latency.std 0 1500000001
+`
+
+	actual := h.Flush()
+	if actual != expected {
+		t.Errorf("Wrong Graphite output. Expected:\n%s\nActual:\n%s", expected, actual)
+	}
+}
+
+func TestTimerFieldsIntegration(t *testing.T) {
+	h := newTestHarness(t, time.Unix(1500000000, 0), func(config *Config) {
+		config.FlushInterval = 1000
+		config.Percentiles = []float64{50}
+		config.TimerFields = []string{"upper", "mean"}
+		config.PercentileFields = []string{"upper", "mean"}
+		config.SkipEmptyMetrics = true
+	})
+
+	defer h.Close()
+
+	h.Send("hits:1|c\nlatency:10|ms\nlatency:30|ms")
+
+	expected := `statsd.bad_lines_seen.count 0 1500000001
+statsd.bad_lines_seen.rate 0 1500000001
+statsd.bad_sampling_rates.count 0 1500000001
+statsd.bad_sampling_rates.rate 0 1500000001
+statsd.buckets_overflowed.count 0 1500000001
+statsd.buckets_overflowed.rate 0 1500000001
+statsd.buckets_rejected.count 0 1500000001
+statsd.buckets_rejected.rate 0 1500000001
+statsd.hits.count 1 1500000001
+statsd.hits.rate 1 1500000001
+statsd.metrics_dropped.count 0 1500000001
+statsd.metrics_dropped.rate 0 1500000001
+statsd.metrics_recieved.count 3 1500000001
+statsd.metrics_recieved.rate 3 1500000001
+statsd.metrics_too_old.count 0 1500000001
+statsd.metrics_too_old.rate 0 1500000001
+statsd.packets_recieved.count 1 1500000001
+statsd.packets_recieved.rate 1 1500000001
+statsd.latency.upper 30 1500000001
+statsd.latency.mean 20 1500000001
+statsd.latency.upper_50 10 1500000001
+statsd.latency.mean_50 10 1500000001
+`
+
+	actual := h.Flush()
+	if actual != expected {
+		t.Errorf("Wrong Graphite output. Expected:\n%s\nActual:\n%s", expected, actual)
+	}
+
+	expected = `statsd.bad_lines_seen.count 0 1500000002
+statsd.bad_lines_seen.rate 0 1500000002
+statsd.bad_sampling_rates.count 0 1500000002
+statsd.bad_sampling_rates.rate 0 1500000002
+statsd.buckets_overflowed.count 0 1500000002
+statsd.buckets_overflowed.rate 0 1500000002
+statsd.buckets_rejected.count 0 1500000002
+statsd.buckets_rejected.rate 0 1500000002
+statsd.metrics_dropped.count 0 1500000002
+statsd.metrics_dropped.rate 0 1500000002
+statsd.metrics_recieved.count 0 1500000002
+statsd.metrics_recieved.rate 0 1500000002
+statsd.metrics_too_old.count 0 1500000002
+statsd.metrics_too_old.rate 0 1500000002
+statsd.packets_recieved.count 0 1500000002
+statsd.packets_recieved.rate 0 1500000002
+`
+
+	actual = h.Flush()
+	if actual != expected {
+		t.Errorf("Wrong Graphite output. Expected:\n%s\nActual:\n%s", expected, actual)
+	}
+}
+
+func TestSetSketchesIntegration(t *testing.T) {
+	h := newTestHarness(t, time.Unix(1500000000, 0), func(config *Config) {
+		config.FlushInterval = 1000
+		config.SetSketches = true
+	})
+
+	defer h.Close()
+
+	h.Send("users:bob|s\nusers:alice|s\nusers:bob|s")
+
+	expected := `statsd.bad_lines_seen.count 0 1500000001
+statsd.bad_lines_seen.rate 0 1500000001
+statsd.bad_sampling_rates.count 0 1500000001
+statsd.bad_sampling_rates.rate 0 1500000001
+statsd.buckets_overflowed.count 0 1500000001
+statsd.buckets_overflowed.rate 0 1500000001
+statsd.buckets_rejected.count 0 1500000001
+statsd.buckets_rejected.rate 0 1500000001
+statsd.metrics_dropped.count 0 1500000001
+statsd.metrics_dropped.rate 0 1500000001
+statsd.metrics_recieved.count 3 1500000001
+statsd.metrics_recieved.rate 3 1500000001
+statsd.metrics_too_old.count 0 1500000001
+statsd.metrics_too_old.rate 0 1500000001
+statsd.packets_recieved.count 1 1500000001
+statsd.packets_recieved.rate 1 1500000001
+statsd.users 2 1500000001
+`
+
+	actual := h.Flush()
+	if actual != expected {
+		t.Errorf("Wrong Graphite output. Expected:\n%s\nActual:\n%s", expected, actual)
+	}
+}
+
+func TestSetMemberExportsIntegration(t *testing.T) {
+	h := newTestHarness(t, time.Unix(1500000000, 0), func(config *Config) {
+		config.FlushInterval = 1000
+		config.SetMemberExports = []SetMemberExport{{Match: "statsd.flags", MaxMembers: 4}}
+	})
+
+	defer h.Close()
+
+	h.Send("flags:dark mode|s\nflags:beta.ui|s\nflags:zeta|s\nflags:beta.ui|s\nflags:beta_ui|s\nflags:%%|s\nusers:bob|s")
+
+	expected := `statsd.bad_lines_seen.count 0 1500000001
+statsd.bad_lines_seen.rate 0 1500000001
+statsd.bad_sampling_rates.count 0 1500000001
+statsd.bad_sampling_rates.rate 0 1500000001
+statsd.buckets_overflowed.count 0 1500000001
+statsd.buckets_overflowed.rate 0 1500000001
+statsd.buckets_rejected.count 0 1500000001
+statsd.buckets_rejected.rate 0 1500000001
+statsd.flags.members.beta_ui.count 1 1500000001
+statsd.flags.members.beta_ui.rate 1 1500000001
+statsd.flags.members.dark_mode.count 1 1500000001
+statsd.flags.members.dark_mode.rate 1 1500000001
+statsd.metrics_dropped.count 0 1500000001
+statsd.metrics_dropped.rate 0 1500000001
+statsd.metrics_recieved.count 7 1500000001
+statsd.metrics_recieved.rate 7 1500000001
+statsd.metrics_too_old.count 0 1500000001
+statsd.metrics_too_old.rate 0 1500000001
+statsd.packets_recieved.count 1 1500000001
+statsd.packets_recieved.rate 1 1500000001
+statsd.flags 5 1500000001
+statsd.users 1 1500000001
+`
+
+	actual := h.Flush()
+	if actual != expected {
+		t.Errorf("Wrong Graphite output. Expected:\n%s\nActual:\n%s", expected, actual)
+	}
+}
+
+func TestTimerFieldsPrecedenceIntegration(t *testing.T) {
+	h := newTestHarness(t, time.Unix(1500000000, 0), func(config *Config) {
+		config.FlushInterval = 1000
+		config.Percentiles = []float64{50}
+		config.TimerFields = []string{"upper", "mean"}
+		config.PercentileFields = []string{"upper", "mean"}
+		config.SkipEmptyMetrics = true
+		config.TimerOverrides = []TimerOverride{
+			{Match: "statsd.jobs", Fields: []string{"lower"}},
+			{Match: "statsd.api", PercentileFields: []string{"count"}}}
+	})
+
+	defer h.Close()
+
+	h.Send("jobs:10|ms\njobs:30|ms\napi:10|ms\napi:30|ms")
+
+	actual := h.Flush()
+	expected := `statsd.api.upper 30 1500000001
+statsd.api.mean 20 1500000001
+statsd.api.count_50 1 1500000001
+statsd.jobs.lower 10 1500000001
+statsd.jobs.upper_50 10 1500000001
+statsd.jobs.mean_50 10 1500000001
+`
+
+	if i := strings.Index(actual, "statsd.api."); i < 0 || actual[i:] != expected {
+		t.Errorf("Override fields must replace global fields. Expected:\n%s\nActual:\n%s", expected, actual)
+	}
+}
@@ -0,0 +1,57 @@
+package bucket
+
+import "regexp"
+
+type Filter struct {
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+func NewFilter(allow []string, deny []string) (*Filter, error) {
+	allowRegexps, err := compileAll(allow)
+	if err != nil {
+		return nil, err
+	}
+
+	denyRegexps, err := compileAll(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Filter{allow: allowRegexps, deny: denyRegexps}, nil
+}
+
+func (f *Filter) Match(bucket string) bool {
+	for _, re := range f.deny {
+		if re.MatchString(bucket) {
+			return false
+		}
+	}
+
+	if len(f.allow) == 0 {
+		return true
+	}
+
+	for _, re := range f.allow {
+		if re.MatchString(bucket) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func compileAll(exprs []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(exprs))
+
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, re)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,28 @@
+package bucket_test
+
+import (
+	"testing"
+
+	"github.com/evvvvr/yastatsd/internal/bucket"
+)
+
+func TestFilter(t *testing.T) {
+	filter, err := bucket.NewFilter([]string{`^statsd\.app\.`}, []string{`\.user\.\d+`})
+	if err != nil {
+		t.Fatalf("Error creating filter: %s", err)
+	}
+
+	expected := map[string]bool{"statsd.app.requests": true,
+		"statsd.app.user.42.logins": false,
+		"statsd.other.requests":     false}
+
+	for name, isAllowed := range expected {
+		if filter.Match(name) != isAllowed {
+			t.Errorf("Invalid filter result for bucket %s Expected: %t", name, isAllowed)
+		}
+	}
+
+	if _, err := bucket.NewFilter([]string{"("}, nil); err == nil {
+		t.Error("Invalid regular expression must be rejected")
+	}
+}
@@ -0,0 +1,76 @@
+package bucket
+
+import "strings"
+
+type PrefixLimit struct {
+	Prefix     string `yaml:"prefix"`
+	MaxBuckets int    `yaml:"maxBuckets"`
+}
+
+type Limiter struct {
+	maxBuckets   int
+	prefixLimits []PrefixLimit
+	prefixCounts []int
+	known        map[string]struct{}
+}
+
+func NewLimiter(maxBuckets int, prefixLimits []PrefixLimit) *Limiter {
+	return &Limiter{maxBuckets: maxBuckets,
+		prefixLimits: prefixLimits,
+		prefixCounts: make([]int, len(prefixLimits)),
+		known:        make(map[string]struct{})}
+}
+
+func (l *Limiter) Admit(bucket string) bool {
+	if !l.isEnabled() {
+		return true
+	}
+
+	if _, exists := l.known[bucket]; exists {
+		return true
+	}
+
+	if l.maxBuckets > 0 && len(l.known) >= l.maxBuckets {
+		return false
+	}
+
+	for i, limit := range l.prefixLimits {
+		if strings.HasPrefix(bucket, limit.Prefix) && l.prefixCounts[i] >= limit.MaxBuckets {
+			return false
+		}
+	}
+
+	l.Add(bucket)
+
+	return true
+}
+
+func (l *Limiter) Add(bucket string) {
+	if !l.isEnabled() {
+		return
+	}
+
+	if _, exists := l.known[bucket]; exists {
+		return
+	}
+
+	l.known[bucket] = struct{}{}
+
+	for i, limit := range l.prefixLimits {
+		if strings.HasPrefix(bucket, limit.Prefix) {
+			l.prefixCounts[i]++
+		}
+	}
+}
+
+func (l *Limiter) Reset() {
+	l.known = make(map[string]struct{})
+
+	for i := range l.prefixCounts {
+		l.prefixCounts[i] = 0
+	}
+}
+
+func (l *Limiter) isEnabled() bool {
+	return l.maxBuckets > 0 || len(l.prefixLimits) > 0
+}
@@ -0,0 +1,44 @@
+package bucket_test
+
+import (
+	"testing"
+
+	"github.com/evvvvr/yastatsd/internal/bucket"
+)
+
+func TestLimiter(t *testing.T) {
+	limiter := bucket.NewLimiter(3, []bucket.PrefixLimit{{Prefix: "users.", MaxBuckets: 1}})
+
+	admitted := map[string]bool{"a": true, "users.1": true, "users.2": false, "b": true, "c": false}
+
+	for _, name := range []string{"a", "users.1", "users.2", "b", "c"} {
+		if limiter.Admit(name) != admitted[name] {
+			t.Errorf("Invalid limiter result for bucket %s Expected: %t", name, admitted[name])
+		}
+	}
+
+	if !limiter.Admit("a") {
+		t.Error("Known bucket must be admitted")
+	}
+
+	limiter.Reset()
+	limiter.Add("users.1")
+
+	if limiter.Admit("users.2") {
+		t.Error("Bucket over prefix limit must be rejected after reset")
+	}
+
+	if !limiter.Admit("c") {
+		t.Error("Bucket under global limit must be admitted after reset")
+	}
+}
+
+func TestUnlimitedLimiter(t *testing.T) {
+	limiter := bucket.NewLimiter(0, nil)
+
+	for _, name := range []string{"a", "b", "c"} {
+		if !limiter.Admit(name) {
+			t.Errorf("Unlimited limiter must admit bucket %s", name)
+		}
+	}
+}
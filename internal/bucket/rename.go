@@ -0,0 +1,149 @@
+package bucket
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type Rule struct {
+	Match        string            `yaml:"match"`
+	Regex        string            `yaml:"regex"`
+	Replace      string            `yaml:"replace"`
+	Tags         map[string]string `yaml:"tags"`
+	DropSegments []int             `yaml:"dropSegments"`
+	Lowercase    bool              `yaml:"lowercase"`
+}
+
+type RuleTest struct {
+	Input    string `yaml:"input"`
+	Expected string `yaml:"expected"`
+}
+
+type Renamer struct {
+	rules []compiledRule
+}
+
+type compiledRule struct {
+	Rule
+	re *regexp.Regexp
+}
+
+func NewRenamer(rules []Rule) (*Renamer, error) {
+	compiled := make([]compiledRule, 0, len(rules))
+
+	for _, rule := range rules {
+		re, err := CompilePattern(rule.Match, rule.Regex)
+		if err != nil {
+			return nil, err
+		}
+
+		compiled = append(compiled, compiledRule{Rule: rule, re: re})
+	}
+
+	return &Renamer{rules: compiled}, nil
+}
+
+func CompilePattern(match string, regex string) (*regexp.Regexp, error) {
+	if match != "" && regex != "" {
+		return nil, fmt.Errorf("Rule can't have both match and regex: %s, %s", match, regex)
+	}
+
+	expr := regex
+	if match != "" {
+		expr = globToRegexp(match)
+	}
+
+	if expr == "" {
+		return nil, nil
+	}
+
+	return regexp.Compile(expr)
+}
+
+func (r *Renamer) Rename(bucket string) string {
+	name, tags := SplitTags(bucket)
+
+	for _, rule := range r.rules {
+		name, tags = rule.apply(name, tags)
+	}
+
+	return JoinTags(name, tags)
+}
+
+func (r *Renamer) Check(tests []RuleTest) error {
+	for _, test := range tests {
+		actual := r.Rename(test.Input)
+
+		if actual != test.Expected {
+			return fmt.Errorf("Bucket %s renamed to %s, expected %s", test.Input, actual, test.Expected)
+		}
+	}
+
+	return nil
+}
+
+func (rule *compiledRule) apply(name string, tags map[string]string) (string, map[string]string) {
+	if rule.re != nil {
+		match := rule.re.FindStringSubmatchIndex(name)
+
+		if match == nil {
+			return name, tags
+		}
+
+		for k, template := range rule.Tags {
+			if tags == nil {
+				tags = make(map[string]string)
+			}
+
+			tags[k] = string(rule.re.ExpandString(nil, template, name, match))
+		}
+
+		if rule.Replace != "" {
+			name = string(rule.re.ExpandString(nil, rule.Replace, name, match))
+		}
+	}
+
+	if len(rule.DropSegments) > 0 {
+		name = dropSegments(name, rule.DropSegments)
+	}
+
+	if rule.Lowercase {
+		name = strings.ToLower(name)
+	}
+
+	return name, tags
+}
+
+func dropSegments(name string, indexes []int) string {
+	segments := strings.Split(name, ".")
+	dropped := make(map[int]struct{}, len(indexes))
+
+	for _, i := range indexes {
+		if i < 0 {
+			i += len(segments)
+		}
+
+		dropped[i] = struct{}{}
+	}
+
+	res := make([]string, 0, len(segments))
+
+	for i, segment := range segments {
+		if _, isDropped := dropped[i]; !isDropped {
+			res = append(res, segment)
+		}
+	}
+
+	return strings.Join(res, ".")
+}
+
+func globToRegexp(glob string) string {
+	parts := strings.Split(glob, "*")
+
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+
+	return "^" + strings.Join(parts, `([^.]+)`) + "$"
+}
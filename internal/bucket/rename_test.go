@@ -0,0 +1,66 @@
+package bucket_test
+
+import (
+	"testing"
+
+	"github.com/evvvvr/yastatsd/internal/bucket"
+)
+
+func TestRename(t *testing.T) {
+	rules := []bucket.Rule{
+		{Match: "app.*.request.*", Replace: "app.requests.$2", Tags: map[string]string{"host": "$1"}},
+		{Regex: `^lib\.([^.]+)\.`, DropSegments: []int{0}},
+		{Lowercase: true}}
+
+	renamer, err := bucket.NewRenamer(rules)
+	if err != nil {
+		t.Fatalf("Error creating renamer: %s", err)
+	}
+
+	tests := []bucket.RuleTest{
+		{Input: "app.web01.request.GET", Expected: "app.requests.get;host=web01"},
+		{Input: "app.web01.request.GET.extra", Expected: "app.web01.request.get.extra"},
+		{Input: "lib.Http.Latency", Expected: "http.latency"},
+		{Input: "other;env=prod", Expected: "other;env=prod"}}
+
+	for _, test := range tests {
+		actual := renamer.Rename(test.Input)
+
+		if actual != test.Expected {
+			t.Errorf("Invalid renamed bucket for %s Expected: %s, Actual: %s",
+				test.Input, test.Expected, actual)
+		}
+	}
+
+	if err := renamer.Check(tests); err != nil {
+		t.Errorf("Rule tests must pass: %s", err)
+	}
+
+	if err := renamer.Check([]bucket.RuleTest{{Input: "a", Expected: "b"}}); err == nil {
+		t.Error("Failing rule test must be reported")
+	}
+}
+
+func TestInvalidRule(t *testing.T) {
+	if _, err := bucket.NewRenamer([]bucket.Rule{{Regex: "("}}); err == nil {
+		t.Error("Invalid regular expression must be rejected")
+	}
+
+	if _, err := bucket.NewRenamer([]bucket.Rule{{Match: "a.*", Regex: "a"}}); err == nil {
+		t.Error("Rule with both match and regex must be rejected")
+	}
+}
+
+func TestTags(t *testing.T) {
+	joined := bucket.JoinTags("a.b", map[string]string{"z": "1", "env": "prod"})
+
+	if joined != "a.b;env=prod;z=1" {
+		t.Fatalf("Invalid joined bucket. Expected: %s, Actual: %s", "a.b;env=prod;z=1", joined)
+	}
+
+	name, tags := bucket.SplitTags(joined)
+
+	if name != "a.b" || len(tags) != 2 || tags["env"] != "prod" || tags["z"] != "1" {
+		t.Fatalf("Invalid split bucket %s: %s, %v", joined, name, tags)
+	}
+}
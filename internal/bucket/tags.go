@@ -0,0 +1,48 @@
+package bucket
+
+import (
+	"sort"
+	"strings"
+)
+
+func JoinTags(name string, tags map[string]string) string {
+	if len(tags) == 0 {
+		return name
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys)+1)
+	parts = append(parts, name)
+
+	for _, k := range keys {
+		parts = append(parts, k+"="+tags[k])
+	}
+
+	return strings.Join(parts, ";")
+}
+
+func SplitTags(bucket string) (string, map[string]string) {
+	parts := strings.Split(bucket, ";")
+
+	if len(parts) == 1 {
+		return bucket, nil
+	}
+
+	tags := make(map[string]string, len(parts)-1)
+
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+
+		if len(kv) == 2 && kv[0] != "" {
+			tags[kv[0]] = kv[1]
+		}
+	}
+
+	return parts[0], tags
+}
@@ -0,0 +1,133 @@
+package hll
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+const (
+	MIN_PRECISION     = 4
+	MAX_PRECISION     = 18
+	DEFAULT_PRECISION = 14
+)
+
+// Sketch is a HyperLogLog cardinality estimator using 2^precision one byte
+// registers; its standard error is about 1.04/sqrt(2^precision).
+type Sketch struct {
+	precision uint
+	registers []uint8
+}
+
+func New(precision int) (*Sketch, error) {
+	if precision < MIN_PRECISION || precision > MAX_PRECISION {
+		return nil, fmt.Errorf("Invalid HyperLogLog precision: %d", precision)
+	}
+
+	return &Sketch{precision: uint(precision), registers: make([]uint8, 1<<uint(precision))}, nil
+}
+
+// FromBytes restores a sketch saved with Bytes; the precision is derived
+// from the count of registers.
+func FromBytes(registers []byte) (*Sketch, error) {
+	precision := bits.TrailingZeros(uint(len(registers)))
+
+	if len(registers) == 0 || 1<<uint(precision) != len(registers) ||
+		precision < MIN_PRECISION || precision > MAX_PRECISION {
+		return nil, fmt.Errorf("Invalid HyperLogLog registers length: %d", len(registers))
+	}
+
+	return &Sketch{precision: uint(precision), registers: append([]uint8{}, registers...)}, nil
+}
+
+func (s *Sketch) Add(value string) {
+	h := hash(value)
+	i := h >> (64 - s.precision)
+	rank := uint8(bits.LeadingZeros64(h<<s.precision|1<<(s.precision-1)) + 1)
+
+	if rank > s.registers[i] {
+		s.registers[i] = rank
+	}
+}
+
+func (s *Sketch) Estimate() uint64 {
+	m := float64(len(s.registers))
+	sum := 0.0
+	zeros := 0
+
+	for _, r := range s.registers {
+		sum += 1 / float64(uint64(1)<<r)
+
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	estimate := alpha(len(s.registers)) * m * m / sum
+
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return uint64(estimate + 0.5)
+}
+
+func (s *Sketch) Merge(other *Sketch) error {
+	if s.precision != other.precision {
+		return fmt.Errorf("Can't merge HyperLogLog sketches with precisions %d and %d", s.precision, other.precision)
+	}
+
+	for i, r := range other.registers {
+		if r > s.registers[i] {
+			s.registers[i] = r
+		}
+	}
+
+	return nil
+}
+
+func (s *Sketch) Reset() {
+	for i := range s.registers {
+		s.registers[i] = 0
+	}
+}
+
+func (s *Sketch) Clone() *Sketch {
+	return &Sketch{precision: s.precision, registers: append([]uint8{}, s.registers...)}
+}
+
+func (s *Sketch) Bytes() []byte {
+	return append([]byte{}, s.registers...)
+}
+
+func alpha(m int) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	}
+
+	return 0.7213 / (1 + 1.079/float64(m))
+}
+
+// hash is FNV-1a finished with the MurmurHash3 mixer, as FNV alone does not
+// spread short similar strings over the high bits used for register indexes.
+func hash(value string) uint64 {
+	h := uint64(14695981039346656037)
+
+	for i := 0; i < len(value); i++ {
+		h ^= uint64(value[i])
+		h *= 1099511628211
+	}
+
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+
+	return h
+}
@@ -0,0 +1,127 @@
+package hll_test
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/evvvvr/yastatsd/internal/hll"
+)
+
+func TestSketchEstimate(t *testing.T) {
+	for _, cardinality := range []int{0, 1, 10, 1000, 100000} {
+		s, err := hll.New(hll.DEFAULT_PRECISION)
+		if err != nil {
+			t.Fatalf("Error creating sketch: %s", err)
+		}
+
+		for i := 0; i < cardinality; i++ {
+			s.Add("user" + strconv.Itoa(i))
+			s.Add("user" + strconv.Itoa(i))
+		}
+
+		estimate := float64(s.Estimate())
+
+		if math.Abs(estimate-float64(cardinality)) > 0.02*float64(cardinality)+0.5 {
+			t.Errorf("Wrong estimate. Expected: %d, Actual: %v", cardinality, estimate)
+		}
+	}
+}
+
+func TestSketchMerge(t *testing.T) {
+	a, _ := hll.New(10)
+	b, _ := hll.New(10)
+
+	for i := 0; i < 500; i++ {
+		a.Add(strconv.Itoa(i))
+		b.Add(strconv.Itoa(i + 250))
+	}
+
+	restored, err := hll.FromBytes(b.Bytes())
+	if err != nil {
+		t.Fatalf("Error restoring sketch: %s", err)
+	}
+
+	err = a.Merge(restored)
+	if err != nil {
+		t.Fatalf("Error merging sketches: %s", err)
+	}
+
+	if estimate := a.Estimate(); estimate < 700 || estimate > 800 {
+		t.Errorf("Wrong merged estimate. Expected: ~750, Actual: %d", estimate)
+	}
+
+	c, _ := hll.New(12)
+	if a.Merge(c) == nil {
+		t.Error("Sketches with different precisions must not be merged")
+	}
+
+	a.Reset()
+	if a.Estimate() != 0 {
+		t.Errorf("Reset sketch must be empty, Actual: %d", a.Estimate())
+	}
+}
+
+func TestNewValidatesPrecision(t *testing.T) {
+	for _, precision := range []int{hll.MIN_PRECISION - 1, hll.MAX_PRECISION + 1} {
+		if _, err := hll.New(precision); err == nil {
+			t.Errorf("Precision %d must be rejected", precision)
+		}
+	}
+
+	if _, err := hll.FromBytes(make([]byte, 100)); err == nil {
+		t.Error("Registers length which is not a power of two must be rejected")
+	}
+}
+
+const BENCHMARK_CARDINALITY = 100000
+
+func benchmarkValues() []string {
+	values := make([]string, BENCHMARK_CARDINALITY)
+
+	for i := range values {
+		values[i] = "user-" + strconv.Itoa(i)
+	}
+
+	return values
+}
+
+// The B/op of the two benchmarks compares the memory used to count
+// BENCHMARK_CARDINALITY unique values exactly and with a sketch.
+func BenchmarkExactSet(b *testing.B) {
+	values := benchmarkValues()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		set := make(map[string]struct{})
+
+		for _, value := range values {
+			set[value] = struct{}{}
+		}
+
+		if len(set) != BENCHMARK_CARDINALITY {
+			b.Fatalf("Wrong set length: %d", len(set))
+		}
+	}
+}
+
+func BenchmarkSketch(b *testing.B) {
+	values := benchmarkValues()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		s, _ := hll.New(hll.DEFAULT_PRECISION)
+
+		for _, value := range values {
+			s.Add(value)
+		}
+
+		if s.Estimate() == 0 {
+			b.Fatal("Empty sketch estimate")
+		}
+	}
+}
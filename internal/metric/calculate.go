@@ -1,6 +1,7 @@
 package metric
 
 import (
+	"fmt"
 	"math"
 	"sort"
 
@@ -8,10 +9,28 @@ import (
 )
 
 type CalculatedMetrics struct {
-	Counters map[string]CounterData
-	Timers   map[string]TimerData
-	Gauges   map[string]float64
-	Sets     map[string]map[string]struct{}
+	Counters     map[string]CounterData
+	Timers       map[string]TimerData
+	Gauges       map[string]float64
+	Sets         map[string]map[string]struct{}
+	SetEstimates map[string]uint64
+	SetMembers   map[string][]string
+}
+
+// SetCounts returns the cardinality of every set, exact for Sets and
+// estimated for SetEstimates.
+func (m *CalculatedMetrics) SetCounts() map[string]uint64 {
+	res := make(map[string]uint64, len(m.Sets)+len(m.SetEstimates))
+
+	for bucket, set := range m.Sets {
+		res[bucket] = uint64(len(set))
+	}
+
+	for bucket, estimate := range m.SetEstimates {
+		res[bucket] = estimate
+	}
+
+	return res
 }
 
 type CounterData struct {
@@ -30,6 +49,123 @@ type TimerData struct {
 	Median            float64
 	StandardDeviation float64
 	PercentilesData   map[float64]PercentileData
+	OmitFields        TimerFields
+	OmitPctFields     PercentileFields
+}
+
+type TimerFields uint
+
+const (
+	TimerLower TimerFields = 1 << iota
+	TimerUpper
+	TimerCount
+	TimerCountPerSecond
+	TimerSum
+	TimerMean
+	TimerMedian
+	TimerStandardDeviation
+
+	AllTimerFields = TimerStandardDeviation<<1 - 1
+)
+
+// PercentileUpper also covers the lower_ series of negative percentiles.
+type PercentileFields uint
+
+const (
+	PercentileCount PercentileFields = 1 << iota
+	PercentileUpper
+	PercentileSum
+	PercentileMean
+
+	AllPercentileFields = PercentileMean<<1 - 1
+)
+
+type fieldName struct {
+	field uint
+	name  string
+}
+
+var timerFieldNames = []fieldName{
+	{uint(TimerLower), "lower"},
+	{uint(TimerUpper), "upper"},
+	{uint(TimerCount), "count"},
+	{uint(TimerCountPerSecond), "count_ps"},
+	{uint(TimerSum), "sum"},
+	{uint(TimerMean), "mean"},
+	{uint(TimerMedian), "median"},
+	{uint(TimerStandardDeviation), "std"},
+}
+
+var percentileFieldNames = []fieldName{
+	{uint(PercentileCount), "count"},
+	{uint(PercentileUpper), "upper"},
+	{uint(PercentileSum), "sum"},
+	{uint(PercentileMean), "mean"},
+}
+
+type TimerValue struct {
+	Name  string
+	Value float64
+}
+
+type TimerStats struct {
+	Percentiles   []float64
+	OmitFields    TimerFields
+	OmitPctFields PercentileFields
+}
+
+func ParseTimerFields(names []string) (TimerFields, error) {
+	fields, err := parseFields(names, timerFieldNames, "timer")
+
+	return TimerFields(fields), err
+}
+
+func ParsePercentileFields(names []string) (PercentileFields, error) {
+	fields, err := parseFields(names, percentileFieldNames, "percentile")
+
+	return PercentileFields(fields), err
+}
+
+func parseFields(names []string, fieldNames []fieldName, kind string) (uint, error) {
+	var fields uint
+
+	for _, name := range names {
+		found := false
+
+		for _, f := range fieldNames {
+			if f.name == name {
+				fields |= f.field
+				found = true
+			}
+		}
+
+		if !found {
+			return 0, fmt.Errorf("Unknown %s field: %s", kind, name)
+		}
+	}
+
+	return fields, nil
+}
+
+func (t *TimerData) Emits(field TimerFields) bool {
+	return t.OmitFields&field == 0
+}
+
+func (t *TimerData) EmitsPercentile(field PercentileFields) bool {
+	return t.OmitPctFields&field == 0
+}
+
+func (t *TimerData) Values() []TimerValue {
+	values := []float64{t.Lower, t.Upper, t.Count, t.CountPerSecond, t.Sum, t.Mean, t.Median, t.StandardDeviation}
+	res := make([]TimerValue, 0, len(values))
+
+	for i, f := range timerFieldNames {
+		if t.Emits(TimerFields(f.field)) {
+			res = append(res, TimerValue{Name: f.name, Value: values[i]})
+		}
+	}
+
+	return res
 }
 
 type PercentileData struct {
@@ -40,10 +176,21 @@ type PercentileData struct {
 }
 
 func Calculate(m *Metrics, flushInterval int, percentiles []float64) *CalculatedMetrics {
+	return CalculateWithTimerStats(m, flushInterval, func(string) TimerStats {
+		return TimerStats{Percentiles: percentiles}
+	})
+}
+
+func CalculateWithTimerStats(m *Metrics, flushInterval int, timerStats func(bucket string) TimerStats) *CalculatedMetrics {
 	res := CalculatedMetrics{Counters: make(map[string]CounterData),
-		Timers: make(map[string]TimerData),
-		Gauges: m.Gauges,
-		Sets:   m.Sets}
+		Timers:       make(map[string]TimerData),
+		Gauges:       m.Gauges,
+		Sets:         m.Sets,
+		SetEstimates: make(map[string]uint64, len(m.SetSketches))}
+
+	for bucket, sketch := range m.SetSketches {
+		res.SetEstimates[bucket] = sketch.Estimate()
+	}
 
 	for bucket, counter := range m.Counters {
 		res.Counters[bucket] = CounterData{Value: counter,
@@ -54,6 +201,7 @@ func Calculate(m *Metrics, flushInterval int, percentiles []float64) *Calculated
 		points := timer
 		sort.Float64s(points)
 		seen := len(points)
+		stats := timerStats(bucket)
 
 		if seen > 0 {
 			lower := points[0]
@@ -89,7 +237,7 @@ func Calculate(m *Metrics, flushInterval int, percentiles []float64) *Calculated
 
 			percentilesData := make(map[float64]PercentileData)
 
-			for _, percentile := range percentiles {
+			for _, percentile := range stats.Percentiles {
 				pctSum := points[0]
 				pctMean := points[0]
 				pctUpper := points[seen-1]
@@ -102,12 +250,20 @@ func Calculate(m *Metrics, flushInterval int, percentiles []float64) *Calculated
 						continue
 					}
 
+					if pctCount > seen {
+						pctCount = seen
+					}
+
 					if util.CmpToZero(percentile) > 0 {
 						pctUpper = points[pctCount-1]
 						pctSum = cumulativeValues[pctCount-1]
 					} else {
 						pctUpper = points[seen-pctCount]
-						pctSum = cumulativeValues[seen-1] - cumulativeValues[seen-pctCount-1]
+						pctSum = cumulativeValues[seen-1]
+
+						if pctCount < seen {
+							pctSum -= cumulativeValues[seen-pctCount-1]
+						}
 					}
 
 					pctMean = pctSum / float64(pctCount)
@@ -128,9 +284,11 @@ func Calculate(m *Metrics, flushInterval int, percentiles []float64) *Calculated
 				Mean:              mean,
 				Median:            median,
 				StandardDeviation: standardDeviation,
-				PercentilesData:   percentilesData}
+				PercentilesData:   percentilesData,
+				OmitFields:        stats.OmitFields,
+				OmitPctFields:     stats.OmitPctFields}
 		} else {
-			res.Timers[bucket] = TimerData{Points: points}
+			res.Timers[bucket] = TimerData{Points: points, OmitFields: stats.OmitFields, OmitPctFields: stats.OmitPctFields}
 		}
 	}
 
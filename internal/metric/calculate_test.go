@@ -6,6 +6,7 @@ import (
 	"strconv"
 	"testing"
 
+	"github.com/evvvvr/yastatsd/internal/hll"
 	"github.com/evvvvr/yastatsd/internal/metric"
 )
 
@@ -130,6 +131,101 @@ func TestTimersCalculation(t *testing.T) {
 	}
 }
 
+func TestCalculateWithTimerStats(t *testing.T) {
+	omitFields, err := metric.ParseTimerFields([]string{"lower", "upper", "count", "count_ps", "sum", "median", "std"})
+	if err != nil {
+		t.Fatalf("Error parsing timer fields: %s", err)
+	}
+
+	timers := map[string][]float64{"api": []float64{1, 2, 3, 4}, "jobs": []float64{2, 4}}
+
+	calculatedMetrics := metric.CalculateWithTimerStats(&metric.Metrics{Timers: timers,
+		TimersCount: map[string]float64{"api": 4, "jobs": 2}}, FLUSH_INTERVAL,
+		func(bucket string) metric.TimerStats {
+			if bucket == "jobs" {
+				return metric.TimerStats{OmitFields: omitFields}
+			}
+
+			return metric.TimerStats{Percentiles: []float64{50, 99}}
+		})
+
+	api := calculatedMetrics.Timers["api"]
+	if len(api.PercentilesData) != 2 || len(api.Values()) != 8 {
+		t.Errorf("Invalid api timer data: %+v", api)
+	}
+
+	jobs := calculatedMetrics.Timers["jobs"]
+	values := jobs.Values()
+
+	if len(jobs.PercentilesData) != 0 || len(values) != 1 || values[0].Name != "mean" || values[0].Value != 3 {
+		t.Errorf("Invalid jobs timer values: %+v", values)
+	}
+
+	if jobs.Emits(metric.TimerLower) || !jobs.Emits(metric.TimerMean) {
+		t.Errorf("Invalid jobs timer fields: %b", jobs.OmitFields)
+	}
+}
+
+func TestPercentileBounds(t *testing.T) {
+	timers := map[string][]float64{"api": []float64{1, 2, 3, 4}}
+
+	calculatedMetrics := metric.CalculateWithTimerStats(&metric.Metrics{Timers: timers,
+		TimersCount: map[string]float64{"api": 4}}, FLUSH_INTERVAL,
+		func(bucket string) metric.TimerStats {
+			return metric.TimerStats{Percentiles: []float64{150, 100, -100}}
+		})
+
+	expected := map[float64]metric.PercentileData{150: {Count: 4, Upper: 4, Sum: 10, Mean: 2.5},
+		100:  {Count: 4, Upper: 4, Sum: 10, Mean: 2.5},
+		-100: {Count: 4, Upper: 1, Sum: 10, Mean: 2.5}}
+
+	for pct, pctData := range expected {
+		if actual := calculatedMetrics.Timers["api"].PercentilesData[pct]; actual != pctData {
+			t.Errorf("Invalid data for percentile %v. Expected: %+v, Actual: %+v", pct, pctData, actual)
+		}
+	}
+}
+
+func TestParseTimerFields(t *testing.T) {
+	fields, err := metric.ParseTimerFields([]string{"mean", "std"})
+	if err != nil || fields != metric.TimerMean|metric.TimerStandardDeviation {
+		t.Errorf("Invalid timer fields: %b, %v", fields, err)
+	}
+
+	if _, err := metric.ParseTimerFields([]string{"p99"}); err == nil {
+		t.Error("Unknown timer field must be rejected")
+	}
+
+	pctFields, err := metric.ParsePercentileFields([]string{"upper", "mean"})
+	if err != nil || pctFields != metric.PercentileUpper|metric.PercentileMean {
+		t.Errorf("Invalid percentile fields: %b, %v", pctFields, err)
+	}
+
+	if _, err := metric.ParsePercentileFields([]string{"count_ps"}); err == nil {
+		t.Error("Unknown percentile field must be rejected")
+	}
+}
+
+func TestSetCounts(t *testing.T) {
+	sketch, _ := hll.New(hll.DEFAULT_PRECISION)
+	sketch.Add("a")
+	sketch.Add("b")
+	sketch.Add("a")
+
+	calculatedMetrics := metric.Calculate(&metric.Metrics{
+		Sets:        map[string]map[string]struct{}{"exact": {"a": {}, "b": {}, "c": {}}},
+		SetSketches: map[string]*hll.Sketch{"estimated": sketch}}, FLUSH_INTERVAL, nil)
+
+	if calculatedMetrics.SetEstimates["estimated"] != 2 {
+		t.Errorf("Invalid set estimate: %d", calculatedMetrics.SetEstimates["estimated"])
+	}
+
+	counts := calculatedMetrics.SetCounts()
+	if len(counts) != 2 || counts["exact"] != 3 || counts["estimated"] != 2 {
+		t.Errorf("Invalid set counts: %v", counts)
+	}
+}
+
 func cmpFloats(expected float64, actual float64, messagePrefix string, t *testing.T) {
 	if big.NewFloat(expected).Cmp(big.NewFloat(actual)) != 0 {
 		t.Fatalf("%sExpected: %s, Actual: %s", messagePrefix,
@@ -3,7 +3,9 @@ package metric
 import (
 	"fmt"
 	"math/big"
+	"strings"
 
+	"github.com/evvvvr/yastatsd/internal/hll"
 	"github.com/evvvvr/yastatsd/internal/util"
 )
 
@@ -27,14 +29,36 @@ type Metric struct {
 	DoesGaugeHaveOperation bool
 	Type                   MetricType
 	Sampling               float64
+	Tags                   map[string]string
+	Timestamp              int64
 }
 
+// TimersCount is the estimated count of timer events: each sampled value adds
+// 1/rate to it, while Timers keeps the observed values only. SetSketches
+// replace Sets when set cardinality is estimated instead of counted exactly.
 type Metrics struct {
 	Counters    map[string]float64
 	Timers      map[string][]float64
 	TimersCount map[string]float64
 	Gauges      map[string]float64
 	Sets        map[string]map[string]struct{}
+	SetSketches map[string]*hll.Sketch
+}
+
+func (m *Metric) Clone() *Metric {
+	c := *m
+	c.Bucket = string([]byte(m.Bucket))
+	c.StringValue = string([]byte(m.StringValue))
+
+	if m.Tags != nil {
+		c.Tags = make(map[string]string, len(m.Tags))
+
+		for k, v := range m.Tags {
+			c.Tags[k] = v
+		}
+	}
+
+	return &c
 }
 
 func (a *Metric) Equal(b *Metric) bool {
@@ -69,7 +93,15 @@ func (a *Metric) Equal(b *Metric) bool {
 		areSamplingsEqual = bigASampling.Cmp(bigBSampling) == 0
 	}
 
-	return a.Bucket == b.Bucket && areValuesEqual && areOperationsEqual && areSamplingsEqual
+	areTagsEqual := len(a.Tags) == len(b.Tags)
+	for k, v := range a.Tags {
+		if bValue, exists := b.Tags[k]; !exists || bValue != v {
+			areTagsEqual = false
+		}
+	}
+
+	return a.Bucket == b.Bucket && areValuesEqual && areOperationsEqual && areSamplingsEqual && areTagsEqual &&
+		a.Timestamp == b.Timestamp
 }
 
 func (m *Metric) String() string {
@@ -95,6 +127,14 @@ func (m *Metric) String() string {
 		valueString = m.StringValue
 	} else {
 		valueString = util.FormatFloat(m.FloatValue)
+
+		if m.Type == Gauge && !m.DoesGaugeHaveOperation && util.CmpToZero(m.FloatValue) < 0 {
+			valueString = "=" + valueString
+		}
+
+		if m.Type == Gauge && m.DoesGaugeHaveOperation && util.CmpToZero(m.FloatValue) >= 0 {
+			valueString = "+" + valueString
+		}
 	}
 
 	sampleString := ""
@@ -104,5 +144,23 @@ func (m *Metric) String() string {
 		sampleString = fmt.Sprintf("|@%s", util.FormatFloat(m.Sampling))
 	}
 
-	return fmt.Sprintf("%s:%s|%s%s", m.Bucket, valueString, typeString, sampleString)
+	timestampString := ""
+
+	if m.Timestamp != 0 {
+		timestampString = fmt.Sprintf("|T%d", m.Timestamp)
+	}
+
+	tagsString := ""
+
+	if len(m.Tags) > 0 {
+		tags := make([]string, 0, len(m.Tags))
+
+		for _, k := range util.SortMapKeys(m.Tags) {
+			tags = append(tags, k+":"+m.Tags[k])
+		}
+
+		tagsString = "|#" + strings.Join(tags, ",")
+	}
+
+	return fmt.Sprintf("%s:%s|%s%s%s%s", m.Bucket, valueString, typeString, sampleString, timestampString, tagsString)
 }
@@ -42,6 +42,13 @@ func TestEqual(t *testing.T) {
 	if !setA.Equal(&setB) {
 		t.Error("Set metrics must be equal")
 	}
+
+	taggedA := metric.Metric{Bucket: "test", FloatValue: 1, Type: metric.Gauge, Tags: map[string]string{"env": "prod"}}
+	taggedB := metric.Metric{Bucket: "test", FloatValue: 1, Type: metric.Gauge, Tags: map[string]string{"env": "dev"}}
+
+	if taggedA.Equal(&taggedB) {
+		t.Error("Metrics with different tags must be not equal")
+	}
 }
 
 func TestString(t *testing.T) {
@@ -55,10 +62,31 @@ func TestString(t *testing.T) {
 
 	compareMetricStrings(t, gaugeExpectedString, &gauge)
 
+	positiveGauge := metric.Metric{Bucket: "test", FloatValue: 3000, DoesGaugeHaveOperation: true, Type: metric.Gauge, Sampling: 1}
+	positiveGaugeExpectedString := "test:+3000|g"
+
+	compareMetricStrings(t, positiveGaugeExpectedString, &positiveGauge)
+
+	absoluteGauge := metric.Metric{Bucket: "test", FloatValue: -3000, Type: metric.Gauge, Sampling: 1}
+	absoluteGaugeExpectedString := "test:=-3000|g"
+
+	compareMetricStrings(t, absoluteGaugeExpectedString, &absoluteGauge)
+
 	setMetric := metric.Metric{Bucket: "test", StringValue: "kooka", FloatValue: 9.8, Type: metric.Set, Sampling: 1}
 	metricExpectedString := "test:kooka|s"
 
 	compareMetricStrings(t, metricExpectedString, &setMetric)
+
+	taggedCounter := metric.Metric{Bucket: "hits", FloatValue: 1, Type: metric.Counter, Sampling: 1,
+		Tags: map[string]string{"host": "a", "env": "prod"}}
+	taggedCounterExpectedString := "hits:1|c|#env:prod,host:a"
+
+	compareMetricStrings(t, taggedCounterExpectedString, &taggedCounter)
+
+	timestampedCounter := metric.Metric{Bucket: "hits", FloatValue: 5, Type: metric.Counter, Sampling: 1, Timestamp: 1697040000}
+	timestampedCounterExpectedString := "hits:5|c|T1697040000"
+
+	compareMetricStrings(t, timestampedCounterExpectedString, &timestampedCounter)
 }
 
 func compareMetricStrings(t *testing.T, metricExpectedString string, m *metric.Metric) {
@@ -0,0 +1,144 @@
+package parser_test
+
+import (
+	"testing"
+
+	"github.com/evvvvr/yastatsd/internal/metric"
+	"github.com/evvvvr/yastatsd/internal/parser"
+)
+
+type conformanceResult struct {
+	metrics []metric.Metric
+	errors  int
+}
+
+func TestParseConformance(t *testing.T) {
+	counter := metric.Metric{Bucket: "a", FloatValue: 1, Type: metric.Counter, Sampling: 1}
+	gauge := metric.Metric{Bucket: "a", FloatValue: 1, Type: metric.Gauge, Sampling: 1}
+	set := metric.Metric{Bucket: "a", StringValue: "x", Type: metric.Set, Sampling: 1}
+
+	cases := []struct {
+		name    string
+		input   string
+		strict  conformanceResult
+		lenient conformanceResult
+	}{
+		{"short bucket", "a:1|c",
+			conformanceResult{[]metric.Metric{counter}, 0}, conformanceResult{[]metric.Metric{counter}, 0}},
+		{"newline terminator", "a:1|c\n",
+			conformanceResult{[]metric.Metric{counter}, 0}, conformanceResult{[]metric.Metric{counter}, 0}},
+		{"trailing empty lines", "a:1|c\n\n",
+			conformanceResult{[]metric.Metric{counter}, 1}, conformanceResult{[]metric.Metric{counter}, 0}},
+		{"empty line between metrics", "a:1|c\n\na:1|c",
+			conformanceResult{[]metric.Metric{counter, counter}, 1}, conformanceResult{[]metric.Metric{counter, counter}, 0}},
+		{"empty packet", "",
+			conformanceResult{nil, 1}, conformanceResult{nil, 0}},
+		{"counter sampling", "a:1|c|@0.5",
+			conformanceResult{[]metric.Metric{{Bucket: "a", FloatValue: 1, Type: metric.Counter, Sampling: 0.5}}, 0},
+			conformanceResult{[]metric.Metric{{Bucket: "a", FloatValue: 1, Type: metric.Counter, Sampling: 0.5}}, 0}},
+		{"sampling rate of one", "a:1|c|@1",
+			conformanceResult{[]metric.Metric{counter}, 0}, conformanceResult{[]metric.Metric{counter}, 0}},
+		{"zero sampling rate", "a:1|c|@0",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+		{"negative sampling rate", "a:1|ms|@-0.5",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+		{"sampling rate above one", "a:1|c|@5",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+		{"NaN sampling rate", "a:1|c|@NaN",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+		{"sampling without @", "a:1|c|x0.5",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+		{"sampling without value", "a:1|c|@",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+		{"invalid sampling value", "a:1|c|@x",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+		{"empty field", "a:1|c|",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+		{"gauge sampling", "a:1|g|@0.5",
+			conformanceResult{nil, 1}, conformanceResult{[]metric.Metric{gauge}, 0}},
+		{"gauge unknown field", "a:1|g|foo",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+		{"gauge invalid sampling", "a:1|g|@x",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+		{"set unknown field", "a:x|s|foo",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+		{"set sampling", "a:x|s|@0.5",
+			conformanceResult{nil, 1}, conformanceResult{[]metric.Metric{set}, 0}},
+		{"negative timer", "a:-1|ms",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+		{"zero timer", "a:0|ms",
+			conformanceResult{[]metric.Metric{{Bucket: "a", Type: metric.Timer, Sampling: 1}}, 0},
+			conformanceResult{[]metric.Metric{{Bucket: "a", Type: metric.Timer, Sampling: 1}}, 0}},
+		{"absolute negative gauge", "a:=-1|g",
+			conformanceResult{[]metric.Metric{{Bucket: "a", FloatValue: -1, Type: metric.Gauge}}, 0},
+			conformanceResult{[]metric.Metric{{Bucket: "a", FloatValue: -1, Type: metric.Gauge}}, 0}},
+		{"gauge delta", "a:+1|g",
+			conformanceResult{[]metric.Metric{{Bucket: "a", FloatValue: 1, Type: metric.Gauge, DoesGaugeHaveOperation: true}}, 0},
+			conformanceResult{[]metric.Metric{{Bucket: "a", FloatValue: 1, Type: metric.Gauge, DoesGaugeHaveOperation: true}}, 0}},
+		{"timestamp and tags", "a:1|c|@0.5|T1697040000|#env:prod",
+			conformanceResult{[]metric.Metric{{Bucket: "a", FloatValue: 1, Type: metric.Counter, Sampling: 0.5,
+				Timestamp: 1697040000, Tags: map[string]string{"env": "prod"}}}, 0},
+			conformanceResult{[]metric.Metric{{Bucket: "a", FloatValue: 1, Type: metric.Counter, Sampling: 0.5,
+				Timestamp: 1697040000, Tags: map[string]string{"env": "prod"}}}, 0}},
+		{"empty bucket", ":1|c",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+		{"empty value", "a:|c",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+		{"missing type", "a:1",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+		{"empty type", "a:1|",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+		// Etsy counts an unknown type as a counter and splits a line into
+		// several values on colons; both are errors here.
+		{"unknown type", "a:1|x",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+		{"multiple values", "a:1|c:2|ms",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+		{"multiple values without type", "a:1:2|c",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+		{"invalid value", "a:b|c",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+		{"NaN gauge", "a:NaN|g",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+		{"infinite counter", "a:Inf|c",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+		{"negative infinite gauge delta", "a:-Inf|g",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+		{"overflowing timer", "a:1e400|ms",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+		{"missing colon", "a",
+			conformanceResult{nil, 1}, conformanceResult{nil, 1}},
+	}
+
+	for _, c := range cases {
+		checkConformance(t, c.name+" (strict)", parser.Parser{Strict: true}, c.input, c.strict)
+		checkConformance(t, c.name+" (lenient)", parser.Parser{}, c.input, c.lenient)
+	}
+}
+
+func checkConformance(t *testing.T, name string, p parser.Parser, input string, expected conformanceResult) {
+	var metrics []*metric.Metric
+	var errors int
+
+	p.Parse([]byte(input), func(m *metric.Metric) {
+		metrics = append(metrics, m.Clone())
+	}, func(err error) {
+		errors++
+	})
+
+	if errors != expected.errors {
+		t.Errorf("%s: wrong count of parsing errors. Expected: %d, Actual: %d", name, expected.errors, errors)
+	}
+
+	if len(metrics) != len(expected.metrics) {
+		t.Errorf("%s: wrong count of parsed metrics. Expected: %d, Actual: %d", name, len(expected.metrics), len(metrics))
+		return
+	}
+
+	for i := range expected.metrics {
+		if !expected.metrics[i].Equal(metrics[i]) {
+			t.Errorf("%s: parsed metric is not equal to expected value. Expected: %s, Actual: %s", name,
+				&expected.metrics[i], metrics[i])
+		}
+	}
+}
@@ -1,101 +1,241 @@
 package parser
 
 import (
+	"bytes"
 	"errors"
+	"math"
 	"strconv"
-	"strings"
+	"unsafe"
 
 	"github.com/evvvvr/yastatsd/internal/metric"
 )
 
+var ErrInvalidSamplingRate = errors.New("Metric sampling rate must be greater than 0 and not greater than 1")
+
+var (
+	errEmptyLine            = errors.New("Metric string is empty")
+	errInvalidFormat        = errors.New("Invalid metric string format")
+	errInvalidType          = errors.New("Invalid metric type")
+	errInvalidValue         = errors.New("Invalid metric value format")
+	errNegativeTimer        = errors.New("Timer value must not be negative")
+	errInvalidTimestamp     = errors.New("Invalid metric timestamp format")
+	errInvalidTags          = errors.New("Invalid metric tags format")
+	errInvalidSampling      = errors.New("Invalid metric sampling format")
+	errInvalidSamplingValue = errors.New("Invalid metric sampling value format")
+	errUnsupportedField     = errors.New("Metric field is not supported for metric type")
+)
+
+// Parser parses packets in place. The metric passed to emit points into the
+// packet and is reused for the next line, so it is only valid until emit
+// returns; use Clone to keep it.
+//
+// By default parsing follows Etsy statsd's is_valid_packet: empty lines are
+// skipped, sampling on gauges and sets is ignored, and any other field on them
+// or a negative, NaN or infinite value is an error. It differs from Etsy in
+// that:
+//   - timestamp (|T) and tag (|#) fields are accepted;
+//   - a line holds a single value, so a:1|c:2|ms is an error where Etsy reads
+//     two metrics, as tag values may contain colons;
+//   - an unknown type is an error where Etsy counts it as a counter.
+//
+// Strict parsing also reports empty lines and sampling on gauges and sets as
+// errors, only allowing a single newline to terminate the packet.
+type Parser struct {
+	Strict bool
+	metric metric.Metric
+}
+
 func Parse(input string) ([]*metric.Metric, []error) {
-	metrics := make([]*metric.Metric, 0, 1307)
-	errors := make([]error, 0, 1307)
+	var p Parser
+	var metrics []*metric.Metric
+	var errs []error
 
-	for _, line := range strings.Split(input, "\n") {
-		metric, err := parseLine(line)
+	p.Parse([]byte(input), func(m *metric.Metric) {
+		metrics = append(metrics, m.Clone())
+	}, func(err error) {
+		errs = append(errs, err)
+	})
 
-		if err != nil {
-			errors = append(errors, err)
-		} else {
-			metrics = append(metrics, metric)
-		}
+	return metrics, errs
+}
+
+func (p *Parser) Parse(input []byte, emit func(*metric.Metric), emitError func(error)) {
+	if p.Strict && len(input) > 0 && input[len(input)-1] == '\n' {
+		input = input[:len(input)-1]
 	}
 
-	return metrics, errors
-}
+	for {
+		line := input
+		i := bytes.IndexByte(input, '\n')
+
+		if i >= 0 {
+			line = input[:i]
+		}
 
-func parseLine(line string) (*metric.Metric, error) {
-	if len(line) < 5 {
-		return nil, errors.New("Metric string is too short")
+		switch {
+		case len(line) == 0:
+			if p.Strict {
+				emitError(errEmptyLine)
+			}
+
+		default:
+			err := p.parseLine(line)
+
+			if err != nil {
+				emitError(err)
+			} else {
+				emit(&p.metric)
+			}
+		}
+
+		if i < 0 {
+			return
+		}
+
+		input = input[i+1:]
 	}
+}
 
-	metricParts := strings.Split(line, ":")
+func (p *Parser) parseLine(line []byte) error {
+	i := bytes.IndexByte(line, ':')
 
-	if len(metricParts) < 2 || len(metricParts[0]) == 0 || len(metricParts[1]) == 0 {
-		return nil, errors.New("Invalid metric string format")
+	if i <= 0 || i == len(line)-1 {
+		return errInvalidFormat
 	}
 
-	metricBucket := metricParts[0]
-	moreMetricParts := strings.Split(metricParts[1], "|")
+	metricValue, rest := nextField(line[i+1:])
+	metricType, rest := nextField(rest)
 
-	if len(moreMetricParts) < 2 || len(moreMetricParts[0]) == 0 || len(moreMetricParts[1]) == 0 {
-		return nil, errors.New("Invalid metric string format")
+	if len(metricValue) == 0 || len(metricType) == 0 {
+		return errInvalidFormat
 	}
 
-	metricType := metric.Counter
+	m := &p.metric
+	*m = metric.Metric{Bucket: bytesToString(line[:i]), Sampling: 1.0}
 
-	switch moreMetricParts[1] {
+	switch bytesToString(metricType) {
 	case "c":
-		metricType = metric.Counter
+		m.Type = metric.Counter
 
 	case "ms":
-		metricType = metric.Timer
+		m.Type = metric.Timer
 
 	case "g":
-		metricType = metric.Gauge
+		m.Type = metric.Gauge
 
 	case "s":
-		metricType = metric.Set
+		m.Type = metric.Set
 
 	default:
-		return nil, errors.New("Invalid metric type")
+		return errInvalidType
 	}
 
-	metricValue := moreMetricParts[0]
-	DoesGaugeHaveOperation := false
 	var err error
-	var metricStringValue string
-	var metricFloatValue float64
 
-	if metricType == metric.Set {
-		metricStringValue = metricValue
+	if m.Type == metric.Set {
+		m.StringValue = bytesToString(metricValue)
 	} else {
-		if metricType == metric.Gauge {
-			if strings.HasPrefix(metricValue, "+") || strings.HasPrefix(metricValue, "-") {
-				DoesGaugeHaveOperation = true
+		if m.Type == metric.Gauge {
+			if metricValue[0] == '=' {
+				metricValue = metricValue[1:]
+			} else if metricValue[0] == '+' || metricValue[0] == '-' {
+				m.DoesGaugeHaveOperation = true
 			}
 		}
 
-		metricFloatValue, err = strconv.ParseFloat(metricValue, 64)
+		m.FloatValue, err = strconv.ParseFloat(bytesToString(metricValue), 64)
+
+		if err != nil || math.IsNaN(m.FloatValue) || math.IsInf(m.FloatValue, 0) {
+			return errInvalidValue
+		}
 
-		if err != nil {
-			return nil, errors.New("Invalid metric value format")
+		if m.Type == metric.Timer && m.FloatValue < 0 {
+			return errNegativeTimer
 		}
 	}
 
-	metricSampling := 1.0
-	if (metricType == metric.Counter || metricType == metric.Timer) && (len(moreMetricParts) == 3) {
-		if len(moreMetricParts[2]) < 2 && !strings.HasPrefix(moreMetricParts[2], "@") {
-			return nil, errors.New("Invalid metric sampling format")
+	for rest != nil {
+		var field []byte
+
+		field, rest = nextField(rest)
+
+		switch {
+		case len(field) > 0 && field[0] == 'T':
+			m.Timestamp, err = strconv.ParseInt(bytesToString(field[1:]), 10, 64)
+
+			if err != nil || m.Timestamp <= 0 {
+				return errInvalidTimestamp
+			}
+
+		case len(field) > 0 && field[0] == '#':
+			m.Tags, err = parseTags(field[1:])
+
+			if err != nil {
+				return err
+			}
+
+		case len(field) < 2 || field[0] != '@':
+			return errInvalidSampling
+
+		default:
+			sampling, err := strconv.ParseFloat(bytesToString(field[1:]), 64)
+
+			if err != nil {
+				return errInvalidSamplingValue
+			}
+
+			if !(sampling > 0 && sampling <= 1) {
+				return ErrInvalidSamplingRate
+			}
+
+			if m.Type == metric.Counter || m.Type == metric.Timer {
+				m.Sampling = sampling
+			} else if p.Strict {
+				return errUnsupportedField
+			}
+		}
+	}
+
+	return nil
+}
+
+func nextField(input []byte) ([]byte, []byte) {
+	i := bytes.IndexByte(input, '|')
+
+	if i < 0 {
+		return input, nil
+	}
+
+	return input[:i], input[i+1:]
+}
+
+func parseTags(field []byte) (map[string]string, error) {
+	tags := make(map[string]string)
+
+	for {
+		tag := field
+		i := bytes.IndexByte(field, ',')
+
+		if i >= 0 {
+			tag = field[:i]
+		}
+
+		j := bytes.IndexByte(tag, ':')
+
+		if j <= 0 || j == len(tag)-1 {
+			return nil, errInvalidTags
 		}
 
-		metricSampling, err = strconv.ParseFloat(moreMetricParts[2][1:], 64)
+		tags[string(tag[:j])] = string(tag[j+1:])
 
-		if err != nil {
-			return nil, errors.New("Invalid metric sampling value format")
+		if i < 0 {
+			return tags, nil
 		}
+
+		field = field[i+1:]
 	}
+}
 
-	return &metric.Metric{Bucket: metricBucket, StringValue: metricStringValue, FloatValue: metricFloatValue, Type: metricType, DoesGaugeHaveOperation: DoesGaugeHaveOperation, Sampling: metricSampling}, nil
+func bytesToString(b []byte) string {
+	return *(*string)(unsafe.Pointer(&b))
 }
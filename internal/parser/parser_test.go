@@ -41,20 +41,123 @@ func TestParseMultipleMetrics(t *testing.T) {
 	compareMetrics(t, &gauge, metrics[1])
 }
 
+func TestParseAbsoluteNegativeGauge(t *testing.T) {
+	gauge := metric.Metric{Bucket: "vo.ga", FloatValue: -3, Type: metric.Gauge, Sampling: 1.0}
+
+	metrics, errs := parser.Parse("vo.ga:=-3|g")
+
+	if len(errs) > 0 {
+		t.Fatalf("Error parsing absolute negative gauge: %s", errs[0])
+	}
+
+	if len(metrics) != 1 {
+		t.Fatalf("Wrong count of parsed metrics. Expected: %d, Actual: %d", 1, len(metrics))
+	}
+
+	compareMetrics(t, &gauge, metrics[0])
+}
+
+func TestParseTags(t *testing.T) {
+	counter := metric.Metric{Bucket: "hits", FloatValue: 1, Type: metric.Counter, Sampling: 0.5,
+		Tags: map[string]string{"env": "prod", "host": "a"}}
+
+	metrics, errs := parser.Parse("hits:1|c|@0.5|#env:prod,host:a\nhits:1|c|#env")
+
+	if len(errs) != 1 {
+		t.Fatalf("Wrong count of parsing errors. Expected: %d, Actual: %d", 1, len(errs))
+	}
+
+	if len(metrics) != 1 {
+		t.Fatalf("Wrong count of parsed metrics. Expected: %d, Actual: %d", 1, len(metrics))
+	}
+
+	compareMetrics(t, &counter, metrics[0])
+}
+
+func TestParserReusesMetric(t *testing.T) {
+	var p parser.Parser
+	var buckets []string
+	var clones []*metric.Metric
+
+	packet := []byte("first:1|c\nsecond:2|c")
+
+	p.Parse(packet, func(m *metric.Metric) {
+		buckets = append(buckets, m.Bucket)
+		clones = append(clones, m.Clone())
+	}, func(err error) {
+		t.Errorf("Unexpected parsing error: %s", err)
+	})
+
+	copy(packet, "xxxxxxxxxxxxxxxxxxxxx")
+
+	if len(clones) != 2 || clones[0].Bucket != "first" || clones[1].Bucket != "second" {
+		t.Errorf("Cloned metrics must not reference the packet: %v", clones)
+	}
+
+	if len(buckets) != 2 || buckets[0] != "xxxxx" {
+		t.Errorf("Emitted metrics must reference the packet: %v", buckets)
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	counter := metric.Metric{Bucket: "bucket", FloatValue: 5, Type: metric.Counter, Sampling: 1, Timestamp: 1697040000}
+
+	metrics, errs := parser.Parse("bucket:5|c|T1697040000\nbucket:5|c|Tnow")
+
+	if len(errs) != 1 {
+		t.Fatalf("Wrong count of parsing errors. Expected: %d, Actual: %d", 1, len(errs))
+	}
+
+	if len(metrics) != 1 {
+		t.Fatalf("Wrong count of parsed metrics. Expected: %d, Actual: %d", 1, len(metrics))
+	}
+
+	compareMetrics(t, &counter, metrics[0])
+}
+
+var benchmarkPacket = []byte("api.requests.count:1|c\napi.requests.latency:12.5|ms|@0.5\napi.requests.latency:7|ms\n" +
+	"db.pool.active:+3|g\ndb.pool.idle:=-1|g\nqueue.depth:42|g\nusers.unique:8fd2c1|s\nusers.unique:a91b7e|s\n" +
+	"cache.hits:1|c|@0.1\ncache.misses:1|c\nhttp.status.200:1|c\nhttp.status.500:1|c\n" +
+	"worker.jobs.duration:1532|ms\nworker.jobs.processed:25|c\nworker.jobs.failed:0|c\nbroken line\n")
+
 func BenchmarkParse(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkPacket)))
+
+	input := string(benchmarkPacket)
+
 	for n := 0; n < b.N; n++ {
-		metrics, errs := parser.Parse("voga:3|ms\nvo.ga:-3|g|@0.1\nvo.ga:--3|g|@0.1\nvo.ga:--3|g|@0.1-\n:||@")
+		metrics, errs := parser.Parse(input)
 
-		if len(errs) != 3 {
-			b.Fatalf("Wrong count of parsing errors. Expected: %d, Actual: %d", 3, len(errs))
+		if len(errs) != 1 {
+			b.Fatalf("Wrong count of parsing errors. Expected: %d, Actual: %d", 1, len(errs))
 		}
 
-		if len(metrics) != 2 {
-			b.Fatalf("Wrong count of parsed metrics. Expected: %d, Actual: %d", 2, len(metrics))
+		if len(metrics) != 15 {
+			b.Fatalf("Wrong count of parsed metrics. Expected: %d, Actual: %d", 15, len(metrics))
 		}
 	}
 }
 
+func BenchmarkParserParse(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkPacket)))
+
+	var p parser.Parser
+	var metrics, errs int
+
+	emit := func(m *metric.Metric) { metrics++ }
+	emitError := func(err error) { errs++ }
+
+	for n := 0; n < b.N; n++ {
+		p.Parse(benchmarkPacket, emit, emitError)
+	}
+
+	if metrics != 15*b.N || errs != b.N {
+		b.Fatalf("Wrong count of parsed metrics and errors. Actual: %d, %d", metrics, errs)
+	}
+}
+
 func compareMetrics(t *testing.T, expected, parsed *metric.Metric) {
 	if !expected.Equal(parsed) {
 		t.Errorf("Parsed metric is not equal to expected value. "+
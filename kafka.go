@@ -0,0 +1,294 @@
+package yastatsd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	KAFKA_PRODUCE_API_KEY      = 0
+	KAFKA_PRODUCE_API_VERSION  = 3
+	KAFKA_RECORD_BATCH_MAGIC   = 2
+	KAFKA_ACKS_LEADER          = 1
+	KAFKA_NOT_LEADER_ERROR     = 6
+	KAFKA_MAX_RESPONSE_SIZE    = 1 << 20
+	DEFAULT_KAFKA_CLIENT_ID    = "yastatsd"
+	DEFAULT_KAFKA_TIMEOUT_MSEC = 10000
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// The producer sends every flush to Address and does not discover partition
+// leaders, so Address must be the leader of Partition. A NOT_LEADER response
+// is logged and the flush is dropped.
+type KafkaConfig struct {
+	Address   string `yaml:"address"`
+	Topic     string `yaml:"topic"`
+	Partition int32  `yaml:"partition"`
+	ClientID  string `yaml:"clientId"`
+	Timeout   int    `yaml:"timeout"`
+	Encoding  string `yaml:"encoding"`
+	Batch     bool   `yaml:"batch"`
+}
+
+type kafkaProducer struct {
+	kafkaConfig   *KafkaConfig
+	correlationID int32
+}
+
+func newKafkaProducer(kafkaConfig *KafkaConfig) *kafkaProducer {
+	return &kafkaProducer{kafkaConfig: kafkaConfig}
+}
+
+func (p *kafkaProducer) Produce(messages []producerMessage, t time.Time) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	timeout := time.Duration(p.kafkaConfig.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = DEFAULT_KAFKA_TIMEOUT_MSEC * time.Millisecond
+	}
+
+	conn, err := net.DialTimeout("tcp", p.kafkaConfig.Address, timeout)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return err
+	}
+
+	p.correlationID++
+
+	clientID := p.kafkaConfig.ClientID
+	if clientID == "" {
+		clientID = DEFAULT_KAFKA_CLIENT_ID
+	}
+
+	req := encodeKafkaProduceRequest(p.correlationID, clientID, p.kafkaConfig.Topic, p.kafkaConfig.Partition,
+		int32(timeout/time.Millisecond), messages, t)
+
+	_, err = conn.Write(req)
+	if err != nil {
+		return err
+	}
+
+	return readKafkaProduceResponse(bufio.NewReader(conn), p.correlationID)
+}
+
+func (p *kafkaProducer) Close() error {
+	return nil
+}
+
+func encodeKafkaProduceRequest(correlationID int32, clientID string, topic string, partition int32,
+	timeoutMs int32, messages []producerMessage, t time.Time) []byte {
+	recordBatch := encodeKafkaRecordBatch(messages, t)
+
+	var buf bytes.Buffer
+	writeKafkaInt32(&buf, 0)
+	writeKafkaInt16(&buf, KAFKA_PRODUCE_API_KEY)
+	writeKafkaInt16(&buf, KAFKA_PRODUCE_API_VERSION)
+	writeKafkaInt32(&buf, correlationID)
+	writeKafkaString(&buf, clientID)
+	writeKafkaInt16(&buf, -1)
+	writeKafkaInt16(&buf, KAFKA_ACKS_LEADER)
+	writeKafkaInt32(&buf, timeoutMs)
+	writeKafkaInt32(&buf, 1)
+	writeKafkaString(&buf, topic)
+	writeKafkaInt32(&buf, 1)
+	writeKafkaInt32(&buf, partition)
+	writeKafkaInt32(&buf, int32(len(recordBatch)))
+	buf.Write(recordBatch)
+
+	req := buf.Bytes()
+	binary.BigEndian.PutUint32(req, uint32(len(req)-4))
+
+	return req
+}
+
+func encodeKafkaRecordBatch(messages []producerMessage, t time.Time) []byte {
+	ts := t.UnixNano() / int64(time.Millisecond)
+
+	var records bytes.Buffer
+	for i, message := range messages {
+		var record bytes.Buffer
+		record.WriteByte(0)
+		writeKafkaVarint(&record, 0)
+		writeKafkaVarint(&record, int64(i))
+		writeKafkaVarintBytes(&record, message.Key)
+		writeKafkaVarintBytes(&record, message.Value)
+		writeKafkaVarint(&record, 0)
+
+		writeKafkaVarint(&records, int64(record.Len()))
+		records.Write(record.Bytes())
+	}
+
+	var body bytes.Buffer
+	writeKafkaInt16(&body, 0)
+	writeKafkaInt32(&body, int32(len(messages)-1))
+	writeKafkaInt64(&body, ts)
+	writeKafkaInt64(&body, ts)
+	writeKafkaInt64(&body, -1)
+	writeKafkaInt16(&body, -1)
+	writeKafkaInt32(&body, -1)
+	writeKafkaInt32(&body, int32(len(messages)))
+	body.Write(records.Bytes())
+
+	var batch bytes.Buffer
+	writeKafkaInt64(&batch, 0)
+	writeKafkaInt32(&batch, int32(4+1+4+body.Len()))
+	writeKafkaInt32(&batch, -1)
+	batch.WriteByte(KAFKA_RECORD_BATCH_MAGIC)
+	writeKafkaInt32(&batch, int32(crc32.Checksum(body.Bytes(), crc32cTable)))
+	batch.Write(body.Bytes())
+
+	return batch.Bytes()
+}
+
+func readKafkaProduceResponse(r io.Reader, correlationID int32) error {
+	var size int32
+
+	err := binary.Read(r, binary.BigEndian, &size)
+	if err != nil {
+		return err
+	}
+
+	if size < 4 || size > KAFKA_MAX_RESPONSE_SIZE {
+		return fmt.Errorf("Invalid Kafka response size %d", size)
+	}
+
+	resp := make([]byte, size)
+
+	_, err = io.ReadFull(r, resp)
+	if err != nil {
+		return err
+	}
+
+	d := kafkaDecoder{buf: resp}
+
+	if d.int32() != correlationID {
+		return errors.New("Kafka response correlation id mismatch")
+	}
+
+	topicsCount := d.int32()
+	for i := int32(0); i < topicsCount && d.err == nil; i++ {
+		topic := d.string()
+		partitionsCount := d.int32()
+
+		for j := int32(0); j < partitionsCount && d.err == nil; j++ {
+			partition := d.int32()
+			errorCode := d.int16()
+			d.int64()
+			d.int64()
+
+			if d.err == nil && errorCode == KAFKA_NOT_LEADER_ERROR {
+				return fmt.Errorf("Kafka broker is not the leader for topic %s partition %d", topic, partition)
+			}
+
+			if d.err == nil && errorCode != 0 {
+				return fmt.Errorf("Kafka error code %d for topic %s partition %d", errorCode, topic, partition)
+			}
+		}
+	}
+
+	return d.err
+}
+
+type kafkaDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if len(d.buf) < n {
+		d.err = errors.New("Truncated Kafka response")
+		return nil
+	}
+
+	res := d.buf[:n]
+	d.buf = d.buf[n:]
+
+	return res
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+
+	return 0
+}
+
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+
+	if n < 0 {
+		return ""
+	}
+
+	return string(d.next(int(n)))
+}
+
+func writeKafkaInt16(buf *bytes.Buffer, v int16) {
+	binary.Write(buf, binary.BigEndian, v)
+}
+
+func writeKafkaInt32(buf *bytes.Buffer, v int32) {
+	binary.Write(buf, binary.BigEndian, v)
+}
+
+func writeKafkaInt64(buf *bytes.Buffer, v int64) {
+	binary.Write(buf, binary.BigEndian, v)
+}
+
+func writeKafkaString(buf *bytes.Buffer, s string) {
+	writeKafkaInt16(buf, int16(len(s)))
+	buf.WriteString(s)
+}
+
+func writeKafkaVarint(buf *bytes.Buffer, v int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+	buf.Write(tmp[:n])
+}
+
+func writeKafkaVarintBytes(buf *bytes.Buffer, b []byte) {
+	if b == nil {
+		writeKafkaVarint(buf, -1)
+		return
+	}
+
+	writeKafkaVarint(buf, int64(len(b)))
+	buf.Write(b)
+}
@@ -0,0 +1,120 @@
+package yastatsd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKafkaProducer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+
+	defer listener.Close()
+
+	received := make(chan []byte, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+
+		var size int32
+		binary.Read(r, binary.BigEndian, &size)
+
+		req := make([]byte, size)
+		io.ReadFull(r, req)
+		received <- req
+
+		var resp bytes.Buffer
+		writeKafkaInt32(&resp, 0)
+		writeKafkaInt32(&resp, int32(binary.BigEndian.Uint32(req[4:8])))
+		writeKafkaInt32(&resp, 1)
+		writeKafkaString(&resp, "metrics")
+		writeKafkaInt32(&resp, 1)
+		writeKafkaInt32(&resp, 0)
+		writeKafkaInt16(&resp, 0)
+		writeKafkaInt64(&resp, 0)
+		writeKafkaInt64(&resp, -1)
+		writeKafkaInt32(&resp, 0)
+
+		respBytes := resp.Bytes()
+		binary.BigEndian.PutUint32(respBytes, uint32(len(respBytes)-4))
+		conn.Write(respBytes)
+	}()
+
+	p := newKafkaProducer(&KafkaConfig{Address: listener.Addr().String(), Topic: "metrics", Timeout: 1000})
+
+	err = p.Produce([]producerMessage{{Key: []byte("a"), Value: []byte("1")}, {Value: []byte("2")}}, time.Unix(1000, 0))
+	if err != nil {
+		t.Fatalf("Error producing messages: %s", err)
+	}
+
+	req := <-received
+
+	if apiKey := binary.BigEndian.Uint16(req[0:2]); apiKey != KAFKA_PRODUCE_API_KEY {
+		t.Errorf("Invalid API key: %d", apiKey)
+	}
+
+	if !bytes.Contains(req, []byte("metrics")) {
+		t.Error("Request must contain topic name")
+	}
+
+	var ts bytes.Buffer
+	writeKafkaInt64(&ts, 1000000)
+
+	if !bytes.Contains(req, ts.Bytes()) {
+		t.Error("Records must be timestamped with flush time")
+	}
+
+	batch := encodeKafkaRecordBatch([]producerMessage{{Key: []byte("a"), Value: []byte("1")}}, time.Unix(1, 0))
+	crc := binary.BigEndian.Uint32(batch[17:21])
+
+	if crc != crc32.Checksum(batch[21:], crc32cTable) {
+		t.Error("Invalid record batch checksum")
+	}
+
+	if batchLength := binary.BigEndian.Uint32(batch[8:12]); int(batchLength) != len(batch)-12 {
+		t.Errorf("Invalid record batch length: %d", batchLength)
+	}
+}
+
+func TestKafkaProduceResponseError(t *testing.T) {
+	var resp bytes.Buffer
+	writeKafkaInt32(&resp, 0)
+	writeKafkaInt32(&resp, 7)
+	writeKafkaInt32(&resp, 1)
+	writeKafkaString(&resp, "metrics")
+	writeKafkaInt32(&resp, 1)
+	writeKafkaInt32(&resp, 0)
+	writeKafkaInt16(&resp, KAFKA_NOT_LEADER_ERROR)
+	writeKafkaInt64(&resp, 0)
+	writeKafkaInt64(&resp, -1)
+	writeKafkaInt32(&resp, 0)
+
+	respBytes := resp.Bytes()
+	binary.BigEndian.PutUint32(respBytes, uint32(len(respBytes)-4))
+
+	err := readKafkaProduceResponse(bytes.NewReader(respBytes), 7)
+	if err == nil || !strings.Contains(err.Error(), "not the leader") {
+		t.Errorf("NOT_LEADER error must be reported. Actual: %v", err)
+	}
+
+	err = readKafkaProduceResponse(bytes.NewReader(respBytes), 8)
+	if err == nil {
+		t.Error("Correlation id mismatch must be reported")
+	}
+}
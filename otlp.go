@@ -0,0 +1,241 @@
+package yastatsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/evvvvr/yastatsd/internal/bucket"
+	"github.com/evvvvr/yastatsd/internal/metric"
+	"github.com/evvvvr/yastatsd/internal/util"
+)
+
+const (
+	OTLP_SCOPE_NAME                    = "yastatsd"
+	OTLP_AGGREGATION_TEMPORALITY_DELTA = 1
+)
+
+type OTLPConfig struct {
+	Address            string            `yaml:"address"`
+	Headers            map[string]string `yaml:"headers"`
+	ResourceAttributes map[string]string `yaml:"resourceAttributes"`
+}
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope     `json:"scope"`
+	Metrics []*otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpAttribute struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpMetric struct {
+	Name    string       `json:"name"`
+	Sum     *otlpSum     `json:"sum,omitempty"`
+	Gauge   *otlpGauge   `json:"gauge,omitempty"`
+	Summary *otlpSummary `json:"summary,omitempty"`
+}
+
+type otlpSum struct {
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpSummary struct {
+	DataPoints []otlpSummaryDataPoint `json:"dataPoints"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsDouble          float64         `json:"asDouble"`
+}
+
+type otlpSummaryDataPoint struct {
+	Attributes        []otlpAttribute     `json:"attributes,omitempty"`
+	StartTimeUnixNano string              `json:"startTimeUnixNano"`
+	TimeUnixNano      string              `json:"timeUnixNano"`
+	Count             string              `json:"count"`
+	Sum               float64             `json:"sum"`
+	QuantileValues    []otlpQuantileValue `json:"quantileValues"`
+}
+
+type otlpQuantileValue struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+func flushOTLP(flushInterval time.Duration, periods []periodMetrics, otlpConfig *OTLPConfig) {
+	req := &otlpRequest{}
+
+	for _, p := range periods {
+		req.ResourceMetrics = append(req.ResourceMetrics,
+			formatOTLPRequest(p.metrics, p.start, p.end, otlpConfig.ResourceAttributes).ResourceMetrics...)
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		log.Printf("Error encoding metrics for OTLP endpoint %s - %s", otlpConfig.Address, err)
+		return
+	}
+
+	headers := map[string]string{"Content-Type": "application/json"}
+	for k, v := range otlpConfig.Headers {
+		headers[k] = v
+	}
+
+	client := &http.Client{Timeout: flushInterval}
+
+	err = postHTTP(client, otlpConfig.Address, headers, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Error submitting metrics to OTLP endpoint %s - %s", otlpConfig.Address, err)
+	}
+}
+
+func formatOTLPRequest(m *metric.CalculatedMetrics, start time.Time, end time.Time,
+	resourceAttributes map[string]string) *otlpRequest {
+	startStr := strconv.FormatInt(start.UnixNano(), 10)
+	endStr := strconv.FormatInt(end.UnixNano(), 10)
+
+	metrics := make([]*otlpMetric, 0, len(m.Counters)+len(m.Timers)+len(m.Gauges)+len(m.Sets)+len(m.SetEstimates))
+	sums := make(map[string]*otlpMetric)
+	gauges := make(map[string]*otlpMetric)
+	summaries := make(map[string]*otlpMetric)
+
+	findMetric := func(byName map[string]*otlpMetric, name string, create func() *otlpMetric) *otlpMetric {
+		res, exists := byName[name]
+
+		if !exists {
+			res = create()
+			byName[name] = res
+			metrics = append(metrics, res)
+		}
+
+		return res
+	}
+
+	for _, b := range util.SortMapKeys(m.Counters) {
+		name, tags := bucket.SplitTags(b)
+		sum := findMetric(sums, name, func() *otlpMetric {
+			return &otlpMetric{Name: name, Sum: &otlpSum{AggregationTemporality: OTLP_AGGREGATION_TEMPORALITY_DELTA,
+				IsMonotonic: false}}
+		}).Sum
+
+		sum.DataPoints = append(sum.DataPoints, otlpNumberDataPoint{Attributes: formatOTLPAttributes(tags),
+			StartTimeUnixNano: startStr,
+			TimeUnixNano:      endStr,
+			AsDouble:          m.Counters[b].Value})
+	}
+
+	for _, b := range util.SortMapKeys(m.Timers) {
+		timer := m.Timers[b]
+		name, tags := bucket.SplitTags(b)
+		summary := findMetric(summaries, name, func() *otlpMetric {
+			return &otlpMetric{Name: name, Summary: &otlpSummary{}}
+		}).Summary
+
+		quantiles := []otlpQuantileValue{}
+
+		if len(timer.Points) > 0 {
+			if timer.Emits(metric.TimerLower) {
+				quantiles = append(quantiles, otlpQuantileValue{Quantile: 0, Value: timer.Lower})
+			}
+
+			for _, pct := range sortPercentiles(timer.PercentilesData) {
+				if util.CmpToZero(pct) > 0 && pct < 100 && timer.EmitsPercentile(metric.PercentileUpper) {
+					quantiles = append(quantiles, otlpQuantileValue{Quantile: pct / 100,
+						Value: timer.PercentilesData[pct].Upper})
+				}
+			}
+
+			if timer.Emits(metric.TimerUpper) {
+				quantiles = append(quantiles, otlpQuantileValue{Quantile: 1, Value: timer.Upper})
+			}
+		}
+
+		// Count is scaled by sampling, so Sum is scaled alike to keep Sum/Count
+		// the mean of the points.
+		sum := timer.Sum
+
+		if len(timer.Points) > 0 {
+			sum *= timer.Count / float64(len(timer.Points))
+		}
+
+		summary.DataPoints = append(summary.DataPoints, otlpSummaryDataPoint{Attributes: formatOTLPAttributes(tags),
+			StartTimeUnixNano: startStr,
+			TimeUnixNano:      endStr,
+			Count:             strconv.FormatUint(uint64(math.Round(timer.Count)), 10),
+			Sum:               sum,
+			QuantileValues:    quantiles})
+	}
+
+	addGaugePoint := func(b string, value float64) {
+		name, tags := bucket.SplitTags(b)
+		gauge := findMetric(gauges, name, func() *otlpMetric {
+			return &otlpMetric{Name: name, Gauge: &otlpGauge{}}
+		}).Gauge
+
+		gauge.DataPoints = append(gauge.DataPoints, otlpNumberDataPoint{Attributes: formatOTLPAttributes(tags),
+			StartTimeUnixNano: startStr,
+			TimeUnixNano:      endStr,
+			AsDouble:          value})
+	}
+
+	for _, b := range util.SortMapKeys(m.Gauges) {
+		addGaugePoint(b, m.Gauges[b])
+	}
+
+	setCounts := m.SetCounts()
+
+	for _, b := range util.SortMapKeys(setCounts) {
+		addGaugePoint(b, float64(setCounts[b]))
+	}
+
+	return &otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: formatOTLPAttributes(resourceAttributes)},
+		ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: OTLP_SCOPE_NAME},
+			Metrics: metrics}}}}}
+}
+
+func formatOTLPAttributes(attributes map[string]string) []otlpAttribute {
+	res := make([]otlpAttribute, 0, len(attributes))
+
+	for _, k := range util.SortMapKeys(attributes) {
+		res = append(res, otlpAttribute{Key: k, Value: otlpAnyValue{StringValue: attributes[k]}})
+	}
+
+	return res
+}
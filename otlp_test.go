@@ -0,0 +1,94 @@
+package yastatsd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/evvvvr/yastatsd/internal/metric"
+)
+
+func TestFormatOTLPRequest(t *testing.T) {
+	m := metric.CalculatedMetrics{
+		Counters: map[string]metric.CounterData{"hits;host=a": {Value: 10, Rate: 1},
+			"hits;host=b": {Value: 5, Rate: 0.5}},
+		Timers: map[string]metric.TimerData{"latency": {Points: []float64{1, 2}, Lower: 1, Upper: 2, Count: 4, Sum: 3,
+			PercentilesData: map[float64]metric.PercentileData{90: {Count: 2, Upper: 2}, -50: {Count: 1, Upper: 2}}}},
+		Gauges: map[string]float64{"queue": 7},
+		Sets:   map[string]map[string]struct{}{"users": {"a": {}, "b": {}}}}
+
+	req := formatOTLPRequest(&m, time.Unix(0, 0), time.Unix(10, 0), map[string]string{"service.name": "test"})
+	metrics := req.ResourceMetrics[0].ScopeMetrics[0].Metrics
+
+	if len(metrics) != 4 {
+		t.Fatalf("Wrong count of metrics. Expected: %d, Actual: %d", 4, len(metrics))
+	}
+
+	hits := metrics[0]
+	if hits.Name != "hits" || hits.Sum == nil || len(hits.Sum.DataPoints) != 2 ||
+		hits.Sum.AggregationTemporality != OTLP_AGGREGATION_TEMPORALITY_DELTA || hits.Sum.IsMonotonic {
+		t.Errorf("Invalid counter metric: %+v", hits)
+	} else if hits.Sum.DataPoints[1].Attributes[0].Value.StringValue != "b" ||
+		hits.Sum.DataPoints[1].TimeUnixNano != "10000000000" {
+		t.Errorf("Invalid counter data point: %+v", hits.Sum.DataPoints[1])
+	}
+
+	latency := metrics[1]
+	if latency.Summary == nil {
+		t.Fatalf("Timer must be exported as summary: %+v", latency)
+	}
+
+	if latency.Summary.DataPoints[0].Count != "4" {
+		t.Errorf("Summary count must be scaled by sampling. Actual: %s", latency.Summary.DataPoints[0].Count)
+	}
+
+	if sum := latency.Summary.DataPoints[0].Sum; sum/4 != 1.5 {
+		t.Errorf("Summary sum must be scaled like count to keep the mean of points. Actual: %v", sum)
+	}
+
+	expectedQuantiles := []otlpQuantileValue{{0, 1}, {0.9, 2}, {1, 2}}
+	quantiles := latency.Summary.DataPoints[0].QuantileValues
+
+	if len(quantiles) != len(expectedQuantiles) {
+		t.Fatalf("Invalid quantiles. Expected: %v, Actual: %v", expectedQuantiles, quantiles)
+	}
+
+	for i, q := range quantiles {
+		if q != expectedQuantiles[i] {
+			t.Errorf("Invalid quantile. Expected: %v, Actual: %v", expectedQuantiles[i], q)
+		}
+	}
+
+	if metrics[2].Gauge == nil || metrics[3].Gauge == nil || metrics[3].Gauge.DataPoints[0].AsDouble != 2 {
+		t.Errorf("Gauges and sets must be exported as gauges: %+v, %+v", metrics[2], metrics[3])
+	}
+}
+
+func TestFlushOTLP(t *testing.T) {
+	var req otlpRequest
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" || r.Header.Get("X-Api-Key") != "key" {
+			t.Errorf("Invalid request headers: %v", r.Header)
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			t.Errorf("Error decoding request: %s", err)
+		}
+	}))
+
+	defer server.Close()
+
+	m := metric.CalculatedMetrics{Gauges: map[string]float64{"queue": 7}}
+	otlpConfig := OTLPConfig{Address: server.URL, Headers: map[string]string{"X-Api-Key": "key"}}
+
+	flushOTLP(time.Second, []periodMetrics{{metrics: &m, start: time.Now().Add(-time.Second), end: time.Now()}},
+		&otlpConfig)
+
+	if len(req.ResourceMetrics) != 1 || req.ResourceMetrics[0].ScopeMetrics[0].Metrics[0].Name != "queue" {
+		t.Errorf("Invalid request received: %+v", req)
+	}
+}
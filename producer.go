@@ -0,0 +1,160 @@
+package yastatsd
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/evvvvr/yastatsd/internal/metric"
+	"github.com/evvvvr/yastatsd/internal/util"
+)
+
+const (
+	PRODUCER_ENCODING_JSON = "json"
+	PRODUCER_ENCODING_AVRO = "avro"
+)
+
+// Produce gets the flush time, which producers use as message timestamp.
+type producer interface {
+	Produce(messages []producerMessage, t time.Time) error
+	Close() error
+}
+
+type producerMessage struct {
+	Key   []byte
+	Value []byte
+}
+
+type metricMessage struct {
+	Bucket    string             `json:"bucket"`
+	Type      string             `json:"type"`
+	Timestamp int64              `json:"timestamp"`
+	Values    map[string]float64 `json:"values"`
+}
+
+func flushProducer(p producer, encoding string, batch bool, flushInterval int, periods []periodMetrics,
+	now time.Time) {
+	var messages []producerMessage
+
+	for _, period := range periods {
+		periodMessages, err := formatProducerMessages(encoding, batch, flushInterval, period.metrics,
+			period.timestamp.Unix())
+		if err != nil {
+			log.Printf("Error encoding metrics for producer - %s", err)
+			return
+		}
+
+		messages = append(messages, periodMessages...)
+	}
+
+	err := p.Produce(messages, now)
+	if err != nil {
+		log.Printf("Error producing metrics - %s", err)
+	}
+}
+
+// Batched JSON messages hold the flush document, batched Avro messages an
+// array of Metric records (AVRO_METRIC_BATCH_SCHEMA).
+func formatProducerMessages(encoding string, batch bool, flushInterval int, m *metric.CalculatedMetrics,
+	ts int64) ([]producerMessage, error) {
+	metricMessages := formatMetricMessages(m, ts)
+
+	if batch {
+		var value []byte
+		var err error
+
+		if encoding == PRODUCER_ENCODING_AVRO {
+			value = appendAvroMetrics(nil, metricMessages)
+		} else {
+			value, err = json.Marshal(formatFlushDocument(m, ts, flushInterval))
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return []producerMessage{{Value: value}}, nil
+	}
+
+	messages := make([]producerMessage, 0, len(metricMessages))
+
+	for i := range metricMessages {
+		var value []byte
+		var err error
+
+		if encoding == PRODUCER_ENCODING_AVRO {
+			value = appendAvroMetric(nil, &metricMessages[i])
+		} else {
+			value, err = json.Marshal(&metricMessages[i])
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, producerMessage{Key: []byte(metricMessages[i].Bucket), Value: value})
+	}
+
+	return messages, nil
+}
+
+func formatMetricMessages(m *metric.CalculatedMetrics, ts int64) []metricMessage {
+	messages := make([]metricMessage, 0, len(m.Counters)+len(m.Timers)+len(m.Gauges)+len(m.Sets)+len(m.SetEstimates))
+
+	for _, bucket := range util.SortMapKeys(m.Counters) {
+		counter := m.Counters[bucket]
+
+		messages = append(messages, metricMessage{Bucket: bucket, Type: "counter", Timestamp: ts,
+			Values: map[string]float64{"value": counter.Value, "rate": counter.Rate}})
+	}
+
+	for _, bucket := range util.SortMapKeys(m.Timers) {
+		timer := m.Timers[bucket]
+		values := make(map[string]float64)
+
+		for _, value := range timer.Values() {
+			values[value.Name] = value.Value
+		}
+
+		for pct, pctData := range timer.PercentilesData {
+			pctStr := formatPercentile(pct)
+
+			limitName := "upper_"
+			if util.CmpToZero(pct) < 0 {
+				limitName = "lower_"
+			}
+
+			if timer.EmitsPercentile(metric.PercentileCount) {
+				values["count_"+pctStr] = float64(pctData.Count)
+			}
+
+			if timer.EmitsPercentile(metric.PercentileUpper) {
+				values[limitName+pctStr] = pctData.Upper
+			}
+
+			if timer.EmitsPercentile(metric.PercentileSum) {
+				values["sum_"+pctStr] = pctData.Sum
+			}
+
+			if timer.EmitsPercentile(metric.PercentileMean) {
+				values["mean_"+pctStr] = pctData.Mean
+			}
+		}
+
+		messages = append(messages, metricMessage{Bucket: bucket, Type: "timer", Timestamp: ts, Values: values})
+	}
+
+	for _, bucket := range util.SortMapKeys(m.Gauges) {
+		messages = append(messages, metricMessage{Bucket: bucket, Type: "gauge", Timestamp: ts,
+			Values: map[string]float64{"value": m.Gauges[bucket]}})
+	}
+
+	setCounts := m.SetCounts()
+
+	for _, bucket := range util.SortMapKeys(setCounts) {
+		messages = append(messages, metricMessage{Bucket: bucket, Type: "set", Timestamp: ts,
+			Values: map[string]float64{"count": float64(setCounts[bucket])}})
+	}
+
+	return messages
+}
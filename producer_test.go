@@ -0,0 +1,85 @@
+package yastatsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/evvvvr/yastatsd/internal/metric"
+)
+
+type memoryProducer struct {
+	messages []producerMessage
+}
+
+func (p *memoryProducer) Produce(messages []producerMessage, t time.Time) error {
+	p.messages = append(p.messages, messages...)
+	return nil
+}
+
+func (p *memoryProducer) Close() error {
+	return nil
+}
+
+func TestFlushProducer(t *testing.T) {
+	m := metric.CalculatedMetrics{
+		Counters: map[string]metric.CounterData{"hits": {Value: 10, Rate: 1}},
+		Gauges:   map[string]float64{"queue": 7},
+		Sets:     map[string]map[string]struct{}{"users": {"a": {}}}}
+
+	p := memoryProducer{}
+	periods := []periodMetrics{{metrics: &m, timestamp: time.Now()}}
+	flushProducer(&p, PRODUCER_ENCODING_JSON, false, DEFAULT_FLUSH_INTERVAL_MILLISECONDS, periods, time.Now())
+
+	if len(p.messages) != 3 {
+		t.Fatalf("Wrong count of messages. Expected: %d, Actual: %d", 3, len(p.messages))
+	}
+
+	var message metricMessage
+
+	err := json.Unmarshal(p.messages[1].Value, &message)
+	if err != nil {
+		t.Fatalf("Error decoding message: %s", err)
+	}
+
+	if string(p.messages[1].Key) != "queue" || message.Type != "gauge" || message.Values["value"] != 7 {
+		t.Errorf("Invalid gauge message: %s", p.messages[1].Value)
+	}
+
+	p = memoryProducer{}
+	flushProducer(&p, PRODUCER_ENCODING_JSON, true, DEFAULT_FLUSH_INTERVAL_MILLISECONDS, periods, time.Now())
+
+	if len(p.messages) != 1 || p.messages[0].Key != nil {
+		t.Fatalf("Batch flush must produce single message without key: %v", p.messages)
+	}
+}
+
+func TestAvroMetric(t *testing.T) {
+	message := metricMessage{Bucket: "a", Type: "gauge", Timestamp: 1, Values: map[string]float64{"value": 1}}
+
+	expected := []byte{2, 'a', 10, 'g', 'a', 'u', 'g', 'e', 2, 2, 10, 'v', 'a', 'l', 'u', 'e',
+		0, 0, 0, 0, 0, 0, 0xf0, 0x3f, 0}
+
+	actual := appendAvroMetric(nil, &message)
+
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("Invalid Avro encoding. Expected: %v, Actual: %v", expected, actual)
+	}
+
+	batch := appendAvroMetrics(nil, []metricMessage{message})
+
+	var schema struct {
+		Type  string
+		Items struct{ Name string }
+	}
+
+	err := json.Unmarshal([]byte(AVRO_METRIC_BATCH_SCHEMA), &schema)
+	if err != nil || schema.Type != "array" || schema.Items.Name != "Metric" {
+		t.Errorf("Invalid Avro batch schema: %s", AVRO_METRIC_BATCH_SCHEMA)
+	}
+
+	if batch[0] != 2 || !bytes.Equal(batch[1:len(batch)-1], expected) || batch[len(batch)-1] != 0 {
+		t.Errorf("Invalid Avro batch encoding: %v", batch)
+	}
+}
@@ -1,225 +1,1055 @@
-package main
+package yastatsd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net"
-	"os"
-	"os/signal"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/go-yaml/yaml"
-
+	"github.com/evvvvr/yastatsd/internal/bucket"
+	"github.com/evvvvr/yastatsd/internal/hll"
 	"github.com/evvvvr/yastatsd/internal/metric"
 	"github.com/evvvvr/yastatsd/internal/parser"
 )
 
 type Config struct {
-	UdpServerAddress    string `yaml:"udpServerAddress"`
-	TcpServerAddress    string `yaml:"tcpServerAddress"`
-	FlushInterval       int    `yaml:"flushInterval"`
-	GraphiteAddress     string `yaml:"graphiteAddress"`
-	GraphiteIPV6        bool   `yaml:"graphiteIPV6"`
-	PrefixStats         string `yaml:"prefixStats"`
-	SanitizeBucketNames bool   `yaml:"sanitizeBucketNames"`
+	UdpServerAddress    string         `yaml:"udpServerAddress"`
+	TcpServerAddress    string         `yaml:"tcpServerAddress"`
+	FlushInterval       int            `yaml:"flushInterval"`
+	AlignFlushes        bool           `yaml:"alignFlushes"`
+	MaxBackfillAge      int            `yaml:"maxBackfillAge"`
+	IncomingQueueSize   int            `yaml:"incomingQueueSize"`
+	BackpressurePolicy  string         `yaml:"backpressurePolicy"`
+	ParseMode           string         `yaml:"parseMode"`
+	GraphiteAddress     string         `yaml:"graphiteAddress"`
+	GraphiteIPV6        bool           `yaml:"graphiteIPV6"`
+	InfluxDB            InfluxDBConfig `yaml:"influxDB"`
+	OTLP                OTLPConfig     `yaml:"otlp"`
+	HTTP                HTTPConfig     `yaml:"http"`
+	File                FileConfig     `yaml:"file"`
+	Kafka               KafkaConfig    `yaml:"kafka"`
+	PrefixStats         string         `yaml:"prefixStats"`
+	SanitizeBucketNames bool           `yaml:"sanitizeBucketNames"`
 	Percentiles         []float64
-	DeleteCounters      bool `yaml:"deleteCounters"`
-	DeleteTimers        bool `yaml:"deleteTimers"`
-	DeleteGauges        bool `yaml:"deleteGauges"`
-	DeleteSets          bool `yaml:"deleteSets"`
+	TimerFields         []string          `yaml:"timerFields"`
+	PercentileFields    []string          `yaml:"percentileFields"`
+	TimerOverrides      []TimerOverride   `yaml:"timerOverrides"`
+	SkipEmptyMetrics    bool              `yaml:"skipEmptyMetrics"`
+	DeleteCounters      bool              `yaml:"deleteCounters"`
+	DeleteTimers        bool              `yaml:"deleteTimers"`
+	DeleteGauges        bool              `yaml:"deleteGauges"`
+	DeleteSets          bool              `yaml:"deleteSets"`
+	SetSketches         bool              `yaml:"setSketches"`
+	SetSketchPrecision  int               `yaml:"setSketchPrecision"`
+	SetMemberExports    []SetMemberExport `yaml:"setMemberExports"`
+	GaugeDeltaMode      string            `yaml:"gaugeDeltaMode"`
+	StateFile           string            `yaml:"stateFile"`
+	StateMaxAge         int               `yaml:"stateMaxAge"`
+	PersistCounters     bool              `yaml:"persistCounters"`
+	PersistTimers       bool              `yaml:"persistTimers"`
+	PersistSets         bool              `yaml:"persistSets"`
+	CounterIdleFlushes  int               `yaml:"counterIdleFlushes"`
+	TimerIdleFlushes    int               `yaml:"timerIdleFlushes"`
+	GaugeIdleFlushes    int               `yaml:"gaugeIdleFlushes"`
+	SetIdleFlushes      int               `yaml:"setIdleFlushes"`
+	MaxBuckets          int               `yaml:"maxBuckets"`
+	BucketLimits        []PrefixLimit     `yaml:"bucketLimits"`
+	AllowBuckets        []string          `yaml:"allowBuckets"`
+	DenyBuckets         []string          `yaml:"denyBuckets"`
+	OverflowBucket      string            `yaml:"overflowBucket"`
+	BucketRules         []BucketRule      `yaml:"bucketRules"`
+	BucketRuleTests     []RuleTest        `yaml:"bucketRuleTests"`
+	CaptureFile         string            `yaml:"captureFile"`
 	Debug               bool
 }
 
+type Metrics = metric.Metrics
+
+type CalculatedMetrics = metric.CalculatedMetrics
+
+type PrefixLimit = bucket.PrefixLimit
+
+type BucketRule = bucket.Rule
+
+type RuleTest = bucket.RuleTest
+
+type Server struct {
+	droppedMetrics uint64
+
+	config Config
+	clock  clock
+
+	// mutex guards the metrics, flushMutex serializes flushes so that backends
+	// are only written to outside of mutex and in flush order.
+	mutex           sync.Mutex
+	flushMutex      sync.Mutex
+	metrics         metric.Metrics
+	lastKnownGauges map[string]float64
+	backfillMetrics map[int64]*metric.Metrics
+	lastFlush       time.Time
+	idleFlushes     map[metric.MetricType]map[string]int
+
+	parser            parser.Parser
+	bucketRenamer     *bucket.Renamer
+	defaultTimerStats metric.TimerStats
+	timerOverrides    []compiledTimerOverride
+	setMemberExports  []compiledSetMemberExport
+	bucketFilter      *bucket.Filter
+	bucketLimiter     *bucket.Limiter
+	fileSink          *rotatingFile
+	kafkaSink         producer
+	packetRecorder    *recorder
+
+	packetsRecievedCounter   string
+	metricsRecievedCounter   string
+	errorsCounter            string
+	bucketsRejectedCounter   string
+	bucketsOverflowedCounter string
+	metricsDroppedCounter    string
+	metricsTooOldCounter     string
+	samplingErrorsCounter    string
+	overflowBucket           string
+
+	incomingMetrics chan *metric.Metric
+	udpConn         *net.UDPConn
+	tcpListener     *net.TCPListener
+	connMutex       sync.Mutex
+	conns           map[net.Conn]struct{}
+	readers         sync.WaitGroup
+	flushes         sync.WaitGroup
+	isStarted       bool
+	stopOnce        sync.Once
+	stop            chan struct{}
+	done            chan struct{}
+}
+
 const (
 	DEFAULT_UDP_ADDRESS                 = ":8125"
 	DEFAULT_FLUSH_INTERVAL_MILLISECONDS = 10000
+	MAX_BACKFILL_AGE_MILLISECONDS       = 3600000
 	MAX_UNPROCESSED_INCOMING_METRICS    = 1000
 	MAX_READ_SIZE                       = 65535
 	DEFAULT_TIMER_CAPACITY              = 100
 	PACKETS_RECIEVED_COUNTER            = "packets_recieved"
 	METRICS_RECIEVED_COUNTER            = "metrics_recieved"
 	ERRORS_COUNTER                      = "bad_lines_seen"
+	BUCKETS_REJECTED_COUNTER            = "buckets_rejected"
+	BUCKETS_OVERFLOWED_COUNTER          = "buckets_overflowed"
+	METRICS_DROPPED_COUNTER             = "metrics_dropped"
+	METRICS_TOO_OLD_COUNTER             = "metrics_too_old"
+	SAMPLING_ERRORS_COUNTER             = "bad_sampling_rates"
+	DEFAULT_OVERFLOW_BUCKET             = "__overflow__"
 )
 
-var (
-	config = Config{
+// Parse modes: lenient follows Etsy statsd's packet validation, strict also
+// rejects empty lines and sampling on gauges and sets. See parser.Parser.
+const (
+	PARSE_MODE_LENIENT = "lenient"
+	PARSE_MODE_STRICT  = "strict"
+)
+
+const (
+	BACKPRESSURE_BLOCK       = "block"
+	BACKPRESSURE_DROP_NEWEST = "dropNewest"
+	BACKPRESSURE_DROP_OLDEST = "dropOldest"
+)
+
+// Gauge delta modes decide how a +N/-N delta applies to a gauge which has no
+// value in the current interval: zero starts it from 0, treating the delta as
+// an absolute value, ignore drops the delta and lastKnown starts it from the
+// last value seen, even after deleteGauges. absolute is an alias of zero.
+const (
+	GAUGE_DELTA_ZERO       = "zero"
+	GAUGE_DELTA_ABSOLUTE   = "absolute"
+	GAUGE_DELTA_IGNORE     = "ignore"
+	GAUGE_DELTA_LAST_KNOWN = "lastKnown"
+)
+
+func DefaultConfig() Config {
+	return Config{
 		UdpServerAddress:    DEFAULT_UDP_ADDRESS,
 		TcpServerAddress:    "",
 		FlushInterval:       DEFAULT_FLUSH_INTERVAL_MILLISECONDS,
+		MaxBackfillAge:      MAX_BACKFILL_AGE_MILLISECONDS,
 		GraphiteAddress:     "",
 		PrefixStats:         "statsd",
 		SanitizeBucketNames: true,
-		Percentiles:         []float64{90.0}}
-
-	metrics = metric.Metrics{
-		Counters:    make(map[string]float64),
-		Timers:      make(map[string][]float64),
-		TimersCount: make(map[string]float64),
-		Gauges:      make(map[string]float64),
-		Sets:        make(map[string]map[string]struct{})}
-
-	packetsRecievedCounter string
-	metricsRecievedCounter string
-	errorsCounter          string
-)
+		Percentiles:         []float64{90.0},
+		GaugeDeltaMode:      GAUGE_DELTA_ZERO,
+		SetSketchPrecision:  hll.DEFAULT_PRECISION,
+		IncomingQueueSize:   MAX_UNPROCESSED_INCOMING_METRICS,
+		BackpressurePolicy:  BACKPRESSURE_BLOCK,
+		ParseMode:           PARSE_MODE_LENIENT,
+		OverflowBucket:      DEFAULT_OVERFLOW_BUCKET}
+}
+
+func New(config Config) (*Server, error) {
+	s := Server{config: config,
+		clock: realClock{},
+		metrics: metric.Metrics{
+			Counters:    make(map[string]float64),
+			Timers:      make(map[string][]float64),
+			TimersCount: make(map[string]float64),
+			Gauges:      make(map[string]float64),
+			Sets:        make(map[string]map[string]struct{}),
+			SetSketches: make(map[string]*hll.Sketch)},
+		lastKnownGauges: make(map[string]float64),
+		backfillMetrics: make(map[int64]*metric.Metrics),
+		idleFlushes: map[metric.MetricType]map[string]int{
+			metric.Counter: make(map[string]int),
+			metric.Timer:   make(map[string]int),
+			metric.Gauge:   make(map[string]int),
+			metric.Set:     make(map[string]int)},
+		conns: make(map[net.Conn]struct{}),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{})}
+
+	if config.FlushInterval <= 0 {
+		return nil, fmt.Errorf("Invalid flush interval: %d", config.FlushInterval)
+	}
+
+	if config.IncomingQueueSize <= 0 {
+		return nil, fmt.Errorf("Invalid incoming queue size: %d", config.IncomingQueueSize)
+	}
+
+	switch config.BackpressurePolicy {
+	case BACKPRESSURE_BLOCK, BACKPRESSURE_DROP_NEWEST, BACKPRESSURE_DROP_OLDEST:
+	default:
+		return nil, fmt.Errorf("Invalid backpressure policy: %s", config.BackpressurePolicy)
+	}
+
+	s.incomingMetrics = make(chan *metric.Metric, config.IncomingQueueSize)
+
+	switch config.ParseMode {
+	case PARSE_MODE_LENIENT:
+	case PARSE_MODE_STRICT:
+		s.parser.Strict = true
+	default:
+		return nil, fmt.Errorf("Invalid parse mode: %s", config.ParseMode)
+	}
+
+	if config.SetSketches && (config.SetSketchPrecision < hll.MIN_PRECISION ||
+		config.SetSketchPrecision > hll.MAX_PRECISION) {
+		return nil, fmt.Errorf("Invalid set sketch precision: %d", config.SetSketchPrecision)
+	}
 
-func main() {
-	configFile, err := ioutil.ReadFile("config.yaml")
+	switch config.GaugeDeltaMode {
+	case GAUGE_DELTA_ZERO, GAUGE_DELTA_ABSOLUTE, GAUGE_DELTA_IGNORE, GAUGE_DELTA_LAST_KNOWN:
+	default:
+		return nil, fmt.Errorf("Invalid gauge delta mode: %s", config.GaugeDeltaMode)
+	}
+
+	switch config.File.Format {
+	case "", FILE_FORMAT_JSON, FILE_FORMAT_GRAPHITE:
+	default:
+		return nil, fmt.Errorf("Invalid file format: %s", config.File.Format)
+	}
+
+	switch config.Kafka.Encoding {
+	case "", PRODUCER_ENCODING_JSON, PRODUCER_ENCODING_AVRO:
+	default:
+		return nil, fmt.Errorf("Invalid Kafka encoding: %s", config.Kafka.Encoding)
+	}
+
+	var err error
+
+	s.bucketRenamer, err = bucket.NewRenamer(config.BucketRules)
 	if err != nil {
-		log.Fatalf("Error reading config file: %s", err)
+		return nil, fmt.Errorf("Error compiling bucket rules: %s", err)
 	}
 
-	err = yaml.Unmarshal(configFile, &config)
+	err = s.bucketRenamer.Check(config.BucketRuleTests)
 	if err != nil {
-		log.Fatalf("Error reading config file: %s", err)
+		return nil, fmt.Errorf("Error checking bucket rules: %s", err)
 	}
 
-	packetsRecievedCounter := processBucketName(PACKETS_RECIEVED_COUNTER)
-	metricsRecievedCounter := processBucketName(METRICS_RECIEVED_COUNTER)
-	errorsCounter := processBucketName(ERRORS_COUNTER)
+	s.defaultTimerStats, s.timerOverrides, err = compileTimerStats(&config)
+	if err != nil {
+		return nil, fmt.Errorf("Error compiling timer settings: %s", err)
+	}
 
-	sigChan := make(chan os.Signal)
-	signal.Notify(sigChan, os.Interrupt)
+	s.setMemberExports, err = compileSetMemberExports(config.SetMemberExports)
+	if err != nil {
+		return nil, fmt.Errorf("Error compiling set member exports: %s", err)
+	}
 
-	incomingMetrics := make(chan *metric.Metric, MAX_UNPROCESSED_INCOMING_METRICS)
+	s.packetsRecievedCounter = s.normalizeBucketName(PACKETS_RECIEVED_COUNTER)
+	s.metricsRecievedCounter = s.normalizeBucketName(METRICS_RECIEVED_COUNTER)
+	s.errorsCounter = s.normalizeBucketName(ERRORS_COUNTER)
+	s.bucketsRejectedCounter = s.normalizeBucketName(BUCKETS_REJECTED_COUNTER)
+	s.bucketsOverflowedCounter = s.normalizeBucketName(BUCKETS_OVERFLOWED_COUNTER)
+	s.metricsDroppedCounter = s.normalizeBucketName(METRICS_DROPPED_COUNTER)
+	s.metricsTooOldCounter = s.normalizeBucketName(METRICS_TOO_OLD_COUNTER)
+	s.samplingErrorsCounter = s.normalizeBucketName(SAMPLING_ERRORS_COUNTER)
+
+	if config.OverflowBucket != "" {
+		s.overflowBucket = s.normalizeBucketName(config.OverflowBucket)
+	}
 
-	metrics.Counters[packetsRecievedCounter] = 0
-	metrics.Counters[metricsRecievedCounter] = 0
-	metrics.Counters[errorsCounter] = 0
+	s.bucketFilter, err = bucket.NewFilter(config.AllowBuckets, config.DenyBuckets)
+	if err != nil {
+		return nil, fmt.Errorf("Error compiling bucket rules: %s", err)
+	}
+
+	s.bucketLimiter = bucket.NewLimiter(config.MaxBuckets, config.BucketLimits)
+
+	if config.File.Path != "" {
+		s.fileSink, err = newRotatingFile(&s.config.File)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening metrics file: %s", err)
+		}
+	}
+
+	if config.Kafka.Address != "" {
+		s.kafkaSink = newKafkaProducer(&s.config.Kafka)
+	}
+
+	if config.CaptureFile != "" {
+		s.packetRecorder, err = newRecorder(config.CaptureFile)
+		if err != nil {
+			s.closeSinks()
+			return nil, fmt.Errorf("Error opening capture file: %s", err)
+		}
+	}
 
-	go udpListener(incomingMetrics)
+	s.initSelfMetrics()
+	s.lastFlush = s.clock.Now()
 
-	if config.TcpServerAddress != "" {
-		go tcpListener(incomingMetrics)
+	if config.StateFile != "" {
+		s.restoreState(config.StateFile, time.Duration(config.StateMaxAge)*time.Millisecond)
+		s.resetBucketLimiter()
 	}
 
-	mainLoop(incomingMetrics, sigChan)
+	return &s, nil
 }
 
-func mainLoop(incomingMetrics <-chan *metric.Metric, signal <-chan os.Signal) {
-	flushIntervalDuration := time.Duration(config.FlushInterval) * time.Millisecond
-	flushTicker := time.NewTicker(flushIntervalDuration)
+func (s *Server) Start(ctx context.Context) error {
+	if s.isStarted {
+		return errors.New("Server is already started")
+	}
 
-	for {
-		select {
-		case metric := <-incomingMetrics:
-			metric.Bucket = processBucketName(metric.Bucket)
-			saveMetric(metric)
+	if s.config.UdpServerAddress != "" {
+		udpAddr, err := net.ResolveUDPAddr("udp", s.config.UdpServerAddress)
+		if err != nil {
+			return fmt.Errorf("Error resolving UDP server address: %s", err)
+		}
 
-		case <-flushTicker.C:
-			calculatedMetrics := metric.Calculate(&metrics, config.FlushInterval, config.Percentiles)
+		s.udpConn, err = net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			return fmt.Errorf("Error listening UDP: %s", err)
+		}
 
-			if config.GraphiteAddress != "" {
-				if config.Debug {
-					log.Printf("Flushing metrics to Graphite server: %s", config.GraphiteAddress)
-				}
+		log.Printf("Listening for UDP connections on %s", s.udpConn.LocalAddr())
+	}
 
-				flushMetrics(flushIntervalDuration, calculatedMetrics, config.GraphiteIPV6, config.GraphiteAddress)
-			}
+	if s.config.TcpServerAddress != "" {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", s.config.TcpServerAddress)
+
+		if err == nil {
+			s.tcpListener, err = net.ListenTCP("tcp", tcpAddr)
+		}
 
-			if config.Debug {
-				debugPrint(calculatedMetrics)
+		if err != nil {
+			if s.udpConn != nil {
+				s.udpConn.Close()
 			}
 
-			resetMetrics()
+			return fmt.Errorf("Error listening TCP: %s", err)
+		}
 
-		case <-signal:
-			log.Print("Shutting down the server")
-			return
+		log.Printf("Listening for TCP connections on %s", s.tcpListener.Addr())
+	}
+
+	s.isStarted = true
+
+	s.mutex.Lock()
+	s.lastFlush = s.clock.Now()
+	s.mutex.Unlock()
+
+	if s.udpConn != nil {
+		s.readers.Add(1)
+
+		go func() {
+			defer s.readers.Done()
+			s.readMetrics(s.udpConn)
+		}()
+	}
+
+	if s.tcpListener != nil {
+		s.readers.Add(1)
+
+		go func() {
+			defer s.readers.Done()
+			s.acceptTCP()
+		}()
+	}
+
+	go s.mainLoop(s.nextFlushTime(s.clock.Now()))
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Stop()
+
+		case <-s.stop:
+		}
+	}()
+
+	return nil
+}
+
+func (s *Server) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+
+		if s.udpConn != nil {
+			s.udpConn.Close()
 		}
+
+		if s.tcpListener != nil {
+			s.tcpListener.Close()
+		}
+
+		s.connMutex.Lock()
+
+		for conn := range s.conns {
+			conn.Close()
+		}
+
+		s.conns = nil
+		s.connMutex.Unlock()
+
+		s.readers.Wait()
+
+		if s.isStarted {
+			<-s.done
+			s.flushes.Wait()
+		}
+
+		s.flushMutex.Lock()
+		defer s.flushMutex.Unlock()
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		if s.config.StateFile != "" {
+			s.saveState(s.config.StateFile)
+		}
+
+		s.closeSinks()
+	})
+}
+
+func (s *Server) UDPAddr() net.Addr {
+	if s.udpConn == nil {
+		return nil
 	}
+
+	return s.udpConn.LocalAddr()
 }
 
-func udpListener(incomingMetrics chan<- *metric.Metric) {
-	udpAddr, err := net.ResolveUDPAddr("udp", config.UdpServerAddress)
+func (s *Server) TCPAddr() net.Addr {
+	if s.tcpListener == nil {
+		return nil
+	}
 
-	if err != nil {
-		log.Fatalf("Error resolving UDP server address: %s", err)
+	return s.tcpListener.Addr()
+}
+
+func (s *Server) Snapshot() Metrics {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return copyMetrics(&s.metrics)
+}
+
+func copyMetrics(m *metric.Metrics) metric.Metrics {
+	res := metric.Metrics{Counters: make(map[string]float64, len(m.Counters)),
+		Timers:      make(map[string][]float64, len(m.Timers)),
+		TimersCount: make(map[string]float64, len(m.TimersCount)),
+		Gauges:      make(map[string]float64, len(m.Gauges)),
+		Sets:        make(map[string]map[string]struct{}, len(m.Sets)),
+		SetSketches: make(map[string]*hll.Sketch, len(m.SetSketches))}
+
+	for bucket, counter := range m.Counters {
+		res.Counters[bucket] = counter
 	}
 
-	udpConn, err := net.ListenUDP("udp", udpAddr)
+	for bucket, points := range m.Timers {
+		res.Timers[bucket] = append([]float64{}, points...)
+	}
 
-	if err != nil {
-		log.Fatalf("Error listening UDP: %s", err)
+	for bucket, count := range m.TimersCount {
+		res.TimersCount[bucket] = count
+	}
+
+	for bucket, gauge := range m.Gauges {
+		res.Gauges[bucket] = gauge
 	}
 
-	defer udpConn.Close()
+	for bucket, set := range m.Sets {
+		res.Sets[bucket] = make(map[string]struct{}, len(set))
 
-	log.Printf("Listening for UDP connections on %s", udpAddr)
+		for value := range set {
+			res.Sets[bucket][value] = struct{}{}
+		}
+	}
 
-	readMetrics(udpConn, incomingMetrics)
+	for bucket, sketch := range m.SetSketches {
+		res.SetSketches[bucket] = sketch.Clone()
+	}
+
+	return res
 }
 
-func tcpListener(incomingMetrics chan<- *metric.Metric) {
-	tcpAddr, err := net.ResolveTCPAddr("tcp", config.TcpServerAddress)
+func (s *Server) HandlePacket(packet []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	if err != nil {
-		log.Fatalf("Error resolving TCP server address: %s", err)
+	for _, m := range s.parsePacket(packet, nil) {
+		s.ingestMetric(m)
+	}
+}
+
+func (s *Server) Flush() {
+	s.flushPeriod(s.flushBounds(s.clock.Now()))
+}
+
+func (s *Server) flushBounds(now time.Time) (time.Time, time.Time) {
+	start := now.Add(-time.Duration(s.config.FlushInterval) * time.Millisecond)
+
+	if s.config.AlignFlushes {
+		start = alignTime(now, time.Duration(s.config.FlushInterval)*time.Millisecond)
+	}
+
+	return start, now
+}
+
+// Only the snapshot and reset of the metrics happen under the mutex, so
+// reading packets doesn't stall while backends are written to.
+func (s *Server) flushPeriod(start time.Time, end time.Time) {
+	s.flushMutex.Lock()
+	defer s.flushMutex.Unlock()
+
+	now := end
+	if s.config.AlignFlushes {
+		now = start
+	}
+
+	s.mutex.Lock()
+
+	s.metrics.Counters[s.metricsDroppedCounter] += float64(atomic.SwapUint64(&s.droppedMetrics, 0))
+
+	metrics := copyMetrics(&s.metrics)
+	backfillMetrics := s.backfillMetrics
+
+	s.backfillMetrics = make(map[int64]*metric.Metrics)
+	s.resetMetrics()
+	s.lastFlush = end
+
+	var state []byte
+	var err error
+
+	if s.config.StateFile != "" {
+		state, err = s.encodeState()
+	}
+
+	s.mutex.Unlock()
+
+	calculatedMetrics := metric.CalculateWithTimerStats(&metrics, s.config.FlushInterval, s.timerStats)
+	s.flushCalculatedMetrics([]periodMetrics{{metrics: calculatedMetrics, start: start, end: end, timestamp: now}}, end)
+
+	if s.config.Debug {
+		debugPrint(calculatedMetrics)
 	}
 
-	tcpListener, err := net.ListenTCP("tcp", tcpAddr)
+	s.flushBackfillMetrics(backfillMetrics, end)
 
 	if err != nil {
-		log.Fatalf("Error listening TCP: %s", err)
+		log.Printf("Error encoding state: %s", err)
+	} else if state != nil {
+		writeStateFile(s.config.StateFile, state)
+	}
+}
+
+// Backfilled intervals are sent in one flush, stamped with the start of their
+// interval. With AlignFlushes that is the timestamp an earlier flush of the
+// interval was sent with, and Graphite keeps only the last value written for
+// a timestamp, so there a backfilled point replaces the one sent before.
+func (s *Server) flushBackfillMetrics(backfillMetrics map[int64]*metric.Metrics, now time.Time) {
+	flushIntervalDuration := time.Duration(s.config.FlushInterval) * time.Millisecond
+	intervals := make([]int64, 0, len(backfillMetrics))
+
+	for interval := range backfillMetrics {
+		intervals = append(intervals, interval)
+	}
+
+	if len(intervals) == 0 {
+		return
+	}
+
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+
+	periods := make([]periodMetrics, 0, len(intervals))
+
+	for _, interval := range intervals {
+		start := time.Unix(0, interval)
+		calculatedMetrics := metric.CalculateWithTimerStats(backfillMetrics[interval], s.config.FlushInterval, s.timerStats)
+
+		periods = append(periods, periodMetrics{metrics: calculatedMetrics, start: start,
+			end: start.Add(flushIntervalDuration), timestamp: start})
+	}
+
+	if s.config.Debug {
+		log.Printf("Flushing backfilled metrics for %d intervals starting %s", len(periods), periods[0].start)
+	}
+
+	s.flushCalculatedMetrics(periods, now)
+}
+
+// periodMetrics are the metrics of one flush interval, reported at timestamp.
+type periodMetrics struct {
+	metrics   *metric.CalculatedMetrics
+	start     time.Time
+	end       time.Time
+	timestamp time.Time
+}
+
+// Every backend gets all periods in a single request, except for the HTTP
+// backend, whose flush documents describe one interval each.
+func (s *Server) flushCalculatedMetrics(periods []periodMetrics, now time.Time) {
+	flushIntervalDuration := time.Duration(s.config.FlushInterval) * time.Millisecond
+
+	for i := range periods {
+		periods[i].metrics = s.exportSetMembers(periods[i].metrics)
+
+		if s.config.SkipEmptyMetrics {
+			periods[i].metrics = s.skipEmptyMetrics(periods[i].metrics)
+		}
+	}
+
+	graphitePeriods := periods
+
+	if s.config.GraphiteAddress != "" || (s.fileSink != nil && s.config.File.Format == FILE_FORMAT_GRAPHITE) {
+		graphitePeriods = make([]periodMetrics, len(periods))
+
+		for i, p := range periods {
+			p.metrics = s.addSetMemberCounters(p.metrics)
+			graphitePeriods[i] = p
+		}
+	}
+
+	if s.config.GraphiteAddress != "" {
+		if s.config.Debug {
+			log.Printf("Flushing metrics to Graphite server: %s", s.config.GraphiteAddress)
+		}
+
+		flushMetrics(flushIntervalDuration, graphitePeriods, s.config.GraphiteIPV6, s.config.GraphiteAddress)
+	}
+
+	if s.config.InfluxDB.Address != "" {
+		if s.config.Debug {
+			log.Printf("Flushing metrics to InfluxDB server: %s", s.config.InfluxDB.Address)
+		}
+
+		flushInfluxDB(flushIntervalDuration, periods, &s.config.InfluxDB)
+	}
+
+	if s.config.OTLP.Address != "" {
+		if s.config.Debug {
+			log.Printf("Flushing metrics to OTLP endpoint: %s", s.config.OTLP.Address)
+		}
+
+		flushOTLP(flushIntervalDuration, periods, &s.config.OTLP)
+	}
+
+	if s.config.HTTP.Address != "" {
+		if s.config.Debug {
+			log.Printf("Flushing metrics to HTTP endpoint: %s", s.config.HTTP.Address)
+		}
+
+		for _, p := range periods {
+			flushHTTP(s.config.FlushInterval, p.metrics, p.timestamp, &s.config.HTTP)
+		}
+	}
+
+	if s.fileSink != nil {
+		flushFile(s.fileSink, s.config.FlushInterval, graphitePeriods, now)
+	}
+
+	if s.kafkaSink != nil {
+		if s.config.Debug {
+			log.Printf("Flushing metrics to Kafka broker: %s", s.config.Kafka.Address)
+		}
+
+		flushProducer(s.kafkaSink, s.config.Kafka.Encoding, s.config.Kafka.Batch, s.config.FlushInterval, periods, now)
+	}
+}
+
+func (s *Server) nextFlushTime(now time.Time) time.Time {
+	flushIntervalDuration := time.Duration(s.config.FlushInterval) * time.Millisecond
+
+	if s.config.AlignFlushes {
+		return alignTime(now, flushIntervalDuration).Add(flushIntervalDuration)
+	}
+
+	return now.Add(flushIntervalDuration)
+}
+
+func (s *Server) mainLoop(nextFlush time.Time) {
+	defer close(s.done)
+
+	flushIntervalDuration := time.Duration(s.config.FlushInterval) * time.Millisecond
+	flushTimer := s.clock.After(nextFlush.Sub(s.clock.Now()))
+
+	var lastFlushDone chan struct{}
+
+	for {
+		select {
+		case m := <-s.incomingMetrics:
+			s.mutex.Lock()
+			s.ingestMetric(m)
+			s.mutex.Unlock()
+
+		case <-flushTimer:
+			start, end := s.flushBounds(s.clock.Now())
+
+			if s.config.AlignFlushes {
+				start, end = nextFlush.Add(-flushIntervalDuration), nextFlush
+			}
+
+			lastFlushDone = s.flushAsync(start, end, lastFlushDone)
+
+			nextFlush = nextFlush.Add(flushIntervalDuration)
+			now := s.clock.Now()
+
+			if now.Sub(nextFlush) >= flushIntervalDuration {
+				nextFlush = s.nextFlushTime(now)
+			}
+
+			flushTimer = s.clock.After(nextFlush.Sub(now))
+
+		case <-s.stop:
+			return
+		}
 	}
+}
+
+// Flushes run outside of the main loop, so that it keeps draining the incoming
+// queue while backends are written to. A flush waits for the previous one to
+// finish, so that backends get intervals in order.
+func (s *Server) flushAsync(start time.Time, end time.Time, previousDone <-chan struct{}) chan struct{} {
+	done := make(chan struct{})
+
+	s.flushes.Add(1)
+
+	go func() {
+		defer s.flushes.Done()
+		defer close(done)
+
+		if previousDone != nil {
+			<-previousDone
+		}
 
-	defer tcpListener.Close()
+		s.flushPeriod(start, end)
+	}()
+
+	return done
+}
+
+func (s *Server) closeSinks() {
+	if s.fileSink != nil {
+		s.fileSink.Close()
+	}
+
+	if s.kafkaSink != nil {
+		s.kafkaSink.Close()
+	}
 
-	log.Printf("Listening for TCP connections on %s", tcpAddr)
+	if s.packetRecorder != nil {
+		s.packetRecorder.Close()
+	}
+}
 
+func (s *Server) acceptTCP() {
 	for {
-		tcpConn, err := tcpListener.AcceptTCP()
+		tcpConn, err := s.tcpListener.AcceptTCP()
 
 		if err != nil {
-			log.Fatalf("Error accepting TCP connection: %s", err)
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error accepting TCP connection: %s", err)
+			}
+
+			return
 		}
 
-		go readMetrics(tcpConn, incomingMetrics)
+		if !s.trackConn(tcpConn) {
+			tcpConn.Close()
+			return
+		}
+
+		s.readers.Add(1)
+
+		go func() {
+			defer s.readers.Done()
+			defer s.untrackConn(tcpConn)
+
+			s.readMetrics(tcpConn)
+		}()
 	}
 }
 
-func readMetrics(src io.ReadCloser, incomingMetrics chan<- *metric.Metric) {
+// Connections are tracked so that Stop can close them; none are accepted
+// once Stop has closed the tracked ones.
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+
+	if s.conns == nil {
+		return false
+	}
+
+	s.conns[conn] = struct{}{}
+
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+
+	delete(s.conns, conn)
+}
+
+func (s *Server) readMetrics(src io.ReadCloser) {
 	defer src.Close()
 
 	buf := make([]byte, MAX_READ_SIZE)
+	var parsedMetrics []*metric.Metric
 
 	for {
-		numRead, err := src.Read(buf)
+		numRead, source, err := readPacket(src, buf)
 
 		if err != nil {
-			if err != io.EOF {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
 				log.Printf("Error reading: %s", err)
 			}
 
 			break
 		}
 
-		metrics.Counters[packetsRecievedCounter]++
-		parsedMetrics, errors := parser.Parse(string(buf[:numRead]))
+		if s.packetRecorder != nil {
+			s.packetRecorder.Record(s.clock.Now(), source, buf[:numRead])
+		}
+
+		s.mutex.Lock()
+		parsedMetrics = s.parsePacket(buf[:numRead], parsedMetrics[:0])
+		s.mutex.Unlock()
+
+		for _, m := range parsedMetrics {
+			if !s.enqueueMetric(m) {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) enqueueMetric(m *metric.Metric) bool {
+	switch s.config.BackpressurePolicy {
+	case BACKPRESSURE_DROP_NEWEST:
+		select {
+		case s.incomingMetrics <- m:
+
+		default:
+			atomic.AddUint64(&s.droppedMetrics, 1)
+		}
+
+	case BACKPRESSURE_DROP_OLDEST:
+		for {
+			select {
+			case s.incomingMetrics <- m:
+				return true
+
+			default:
+			}
+
+			select {
+			case <-s.incomingMetrics:
+				atomic.AddUint64(&s.droppedMetrics, 1)
+
+			default:
+			}
+		}
+
+	default:
+		select {
+		case s.incomingMetrics <- m:
+
+		case <-s.stop:
+			return false
+		}
+	}
+
+	return true
+}
+
+func readPacket(src io.Reader, buf []byte) (int, string, error) {
+	switch conn := src.(type) {
+	case *net.UDPConn:
+		numRead, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return numRead, "", err
+		}
+
+		return numRead, addr.String(), nil
+
+	case net.Conn:
+		numRead, err := conn.Read(buf)
 
-		metrics.Counters[metricsRecievedCounter] += float64(len(parsedMetrics))
-		metrics.Counters[errorsCounter] += float64(len(errors))
+		return numRead, conn.RemoteAddr().String(), err
 
-		for _, metric := range parsedMetrics {
-			incomingMetrics <- metric
+	default:
+		numRead, err := src.Read(buf)
+
+		return numRead, "", err
+	}
+}
+
+func (s *Server) parsePacket(packet []byte, parsedMetrics []*metric.Metric) []*metric.Metric {
+	s.metrics.Counters[s.packetsRecievedCounter]++
+
+	s.parser.Parse(packet, func(m *metric.Metric) {
+		s.metrics.Counters[s.metricsRecievedCounter]++
+		parsedMetrics = append(parsedMetrics, m.Clone())
+	}, func(err error) {
+		s.metrics.Counters[s.errorsCounter]++
+
+		if err == parser.ErrInvalidSamplingRate {
+			s.metrics.Counters[s.samplingErrorsCounter]++
 		}
+	})
+
+	return parsedMetrics
+}
+
+func (s *Server) ingestMetric(m *metric.Metric) {
+	if s.isTooOld(m) {
+		s.metrics.Counters[s.metricsTooOldCounter]++
+		return
+	}
+
+	m.Bucket = s.processBucketName(m.Bucket)
+
+	if len(m.Tags) > 0 {
+		m.Bucket = s.mergeBucketTags(m.Bucket, m.Tags)
 	}
+
+	if !s.admitMetric(m) {
+		return
+	}
+
+	if m.Timestamp != 0 && m.Timestamp < s.lastFlush.Unix() {
+		s.saveBackfillMetric(m)
+	} else {
+		s.saveMetric(m)
+	}
+}
+
+// Metrics timestamped more than MaxBackfillAge before the last flush are
+// dropped and counted apart from the ones dropped by backpressure; zero allows
+// any age.
+func (s *Server) isTooOld(m *metric.Metric) bool {
+	maxAge := time.Duration(s.config.MaxBackfillAge) * time.Millisecond
+
+	return m.Timestamp != 0 && maxAge > 0 && s.lastFlush.Sub(time.Unix(m.Timestamp, 0)) > maxAge
 }
 
-func processBucketName(bucket string) string {
-	if config.SanitizeBucketNames {
-		bucket = sanitizeBucketName(bucket)
+func (s *Server) saveBackfillMetric(m *metric.Metric) {
+	interval := alignTime(time.Unix(m.Timestamp, 0), time.Duration(s.config.FlushInterval)*time.Millisecond).UnixNano()
+	metrics, exists := s.backfillMetrics[interval]
+
+	if !exists {
+		metrics = &metric.Metrics{
+			Counters:    make(map[string]float64),
+			Timers:      make(map[string][]float64),
+			TimersCount: make(map[string]float64),
+			Gauges:      make(map[string]float64),
+			Sets:        make(map[string]map[string]struct{}),
+			SetSketches: make(map[string]*hll.Sketch)}
+		s.backfillMetrics[interval] = metrics
 	}
 
-	if config.PrefixStats != "" {
-		bucket = fmt.Sprintf("%s.%s", config.PrefixStats, bucket)
+	s.aggregateMetric(metrics, m)
+}
+
+// Rules see bucket names as sent, so they can match Graphite style tags and
+// characters that sanitizing would remove.
+func (s *Server) processBucketName(bucket string) string {
+	if s.bucketRenamer != nil {
+		bucket = s.bucketRenamer.Rename(bucket)
+	}
+
+	return s.normalizeBucketName(bucket)
+}
+
+func (s *Server) normalizeBucketName(bucket string) string {
+	if s.config.SanitizeBucketNames {
+		bucket = sanitizeTaggedBucketName(bucket)
+	}
+
+	if s.config.PrefixStats != "" {
+		bucket = fmt.Sprintf("%s.%s", s.config.PrefixStats, bucket)
 	}
 
 	return bucket
 }
 
+func (s *Server) mergeBucketTags(bucketName string, metricTags map[string]string) string {
+	name, tags := bucket.SplitTags(bucketName)
+
+	if tags == nil {
+		tags = make(map[string]string)
+	}
+
+	for k, v := range metricTags {
+		if s.config.SanitizeBucketNames {
+			k, v = sanitizeBucketName(k), sanitizeBucketName(v)
+		}
+
+		if k != "" && v != "" {
+			tags[k] = v
+		}
+	}
+
+	return bucket.JoinTags(name, tags)
+}
+
+func sanitizeTaggedBucketName(b string) string {
+	name, tags := bucket.SplitTags(b)
+
+	if len(tags) == 0 {
+		return sanitizeBucketName(name)
+	}
+
+	sanitizedTags := make(map[string]string, len(tags))
+
+	for k, v := range tags {
+		k, v = sanitizeBucketName(k), sanitizeBucketName(v)
+
+		if k != "" && v != "" {
+			sanitizedTags[k] = v
+		}
+	}
+
+	return bucket.JoinTags(sanitizeBucketName(name), sanitizedTags)
+}
+
 func sanitizeBucketName(bucket string) string {
 	res := make([]byte, len(bucket))
 	var resLength int
@@ -242,7 +1072,40 @@ func sanitizeBucketName(bucket string) string {
 	return string(res[:resLength])
 }
 
-func saveMetric(m *metric.Metric) {
+func (s *Server) admitMetric(m *metric.Metric) bool {
+	if !s.bucketFilter.Match(m.Bucket) {
+		s.metrics.Counters[s.bucketsRejectedCounter]++
+		return false
+	}
+
+	if m.Bucket == s.overflowBucket || s.bucketLimiter.Admit(m.Bucket) {
+		return true
+	}
+
+	s.metrics.Counters[s.bucketsOverflowedCounter]++
+
+	if s.overflowBucket == "" {
+		return false
+	}
+
+	m.Bucket = s.overflowBucket
+
+	return true
+}
+
+func (s *Server) saveMetric(m *metric.Metric) {
+	if !s.aggregateMetric(&s.metrics, m) {
+		return
+	}
+
+	if m.Type == metric.Gauge && s.config.GaugeDeltaMode == GAUGE_DELTA_LAST_KNOWN {
+		s.lastKnownGauges[m.Bucket] = s.metrics.Gauges[m.Bucket]
+	}
+
+	s.idleFlushes[m.Type][m.Bucket] = 0
+}
+
+func (s *Server) aggregateMetric(metrics *metric.Metrics, m *metric.Metric) bool {
 	switch m.Type {
 	case metric.Counter:
 		_, exists := metrics.Counters[m.Bucket]
@@ -269,19 +1132,36 @@ func saveMetric(m *metric.Metric) {
 		metrics.TimersCount[m.Bucket] += float64(1 / m.Sampling)
 
 	case metric.Gauge:
-		_, exists := metrics.Gauges[m.Bucket]
+		gauge, exists := metrics.Gauges[m.Bucket]
 
-		if !exists {
-			metrics.Gauges[m.Bucket] = 0
-		}
+		switch {
+		case !m.DoesGaugeHaveOperation:
+			gauge = m.FloatValue
+
+		case exists:
+			gauge += m.FloatValue
 
-		if m.DoesGaugeHaveOperation {
-			metrics.Gauges[m.Bucket] += m.FloatValue
-		} else {
-			metrics.Gauges[m.Bucket] = m.FloatValue
+		default:
+			switch s.config.GaugeDeltaMode {
+			case GAUGE_DELTA_IGNORE:
+				return false
+
+			case GAUGE_DELTA_LAST_KNOWN:
+				gauge = s.lastKnownGauges[m.Bucket] + m.FloatValue
+
+			default:
+				gauge = m.FloatValue
+			}
 		}
 
+		metrics.Gauges[m.Bucket] = gauge
+
 	case metric.Set:
+		if s.config.SetSketches {
+			s.setSketch(metrics, m.Bucket).Add(m.StringValue)
+			break
+		}
+
 		_, exists := metrics.Sets[m.Bucket]
 
 		if !exists {
@@ -290,42 +1170,166 @@ func saveMetric(m *metric.Metric) {
 
 		metrics.Sets[m.Bucket][m.StringValue] = struct{}{}
 	}
+
+	return true
+}
+
+func (s *Server) setSketch(metrics *metric.Metrics, bucket string) *hll.Sketch {
+	sketch, exists := metrics.SetSketches[bucket]
+
+	if !exists {
+		sketch, _ = hll.New(s.config.SetSketchPrecision)
+		metrics.SetSketches[bucket] = sketch
+	}
+
+	return sketch
 }
 
-func resetMetrics() {
-	if config.DeleteCounters {
-		metrics.Counters = make(map[string]float64)
+func (s *Server) resetMetrics() {
+	if s.config.DeleteCounters {
+		s.metrics.Counters = make(map[string]float64)
+		s.idleFlushes[metric.Counter] = make(map[string]int)
 
-		metrics.Counters[packetsRecievedCounter] = 0
-		metrics.Counters[metricsRecievedCounter] = 0
-		metrics.Counters[errorsCounter] = 0
+		s.initSelfMetrics()
 	} else {
-		setMetricsToZeroes(metrics.Counters)
+		setMetricsToZeroes(s.metrics.Counters)
+
+		for bucket, _ := range s.metrics.Counters {
+			if !s.isSelfMetric(bucket) && s.isIdle(metric.Counter, bucket, s.config.CounterIdleFlushes) {
+				delete(s.metrics.Counters, bucket)
+			}
+		}
 	}
 
-	if config.DeleteTimers {
-		metrics.Timers = make(map[string][]float64)
+	if s.config.DeleteTimers {
+		s.metrics.Timers = make(map[string][]float64)
+		s.metrics.TimersCount = make(map[string]float64)
+		s.idleFlushes[metric.Timer] = make(map[string]int)
 	} else {
-		for bucket, _ := range metrics.Timers {
-			metrics.Timers[bucket] = []float64{}
+		for bucket, _ := range s.metrics.Timers {
+			if s.isIdle(metric.Timer, bucket, s.config.TimerIdleFlushes) {
+				delete(s.metrics.Timers, bucket)
+				delete(s.metrics.TimersCount, bucket)
+			} else {
+				s.metrics.Timers[bucket] = []float64{}
+				s.metrics.TimersCount[bucket] = 0
+			}
 		}
 	}
 
-	if config.DeleteGauges {
-		metrics.Gauges = make(map[string]float64)
+	if s.config.DeleteGauges {
+		s.metrics.Gauges = make(map[string]float64)
+		s.expireLastKnownGauges()
+	} else {
+		for bucket, _ := range s.metrics.Gauges {
+			if s.isIdle(metric.Gauge, bucket, s.config.GaugeIdleFlushes) {
+				delete(s.metrics.Gauges, bucket)
+				delete(s.lastKnownGauges, bucket)
+			}
+		}
 	}
 
-	if config.DeleteSets {
-		metrics.Sets = make(map[string]map[string]struct{})
+	if s.config.DeleteSets {
+		s.metrics.Sets = make(map[string]map[string]struct{})
+		s.metrics.SetSketches = make(map[string]*hll.Sketch)
+		s.idleFlushes[metric.Set] = make(map[string]int)
 	} else {
-		for bucket, _ := range metrics.Sets {
-			metrics.Sets[bucket] = make(map[string]struct{})
+		for bucket, _ := range s.metrics.Sets {
+			if s.isIdle(metric.Set, bucket, s.config.SetIdleFlushes) {
+				delete(s.metrics.Sets, bucket)
+			} else {
+				s.metrics.Sets[bucket] = make(map[string]struct{})
+			}
+		}
+
+		for bucket, sketch := range s.metrics.SetSketches {
+			if s.isIdle(metric.Set, bucket, s.config.SetIdleFlushes) {
+				delete(s.metrics.SetSketches, bucket)
+			} else {
+				sketch.Reset()
+			}
+		}
+	}
+
+	s.resetBucketLimiter()
+}
+
+// Deleted gauges keep their last known value until they have been idle for
+// GaugeIdleFlushes flushes.
+func (s *Server) expireLastKnownGauges() {
+	idle := s.idleFlushes[metric.Gauge]
+	s.idleFlushes[metric.Gauge] = make(map[string]int, len(s.lastKnownGauges))
+
+	for bucket, _ := range s.lastKnownGauges {
+		s.idleFlushes[metric.Gauge][bucket] = idle[bucket]
+
+		if s.isIdle(metric.Gauge, bucket, s.config.GaugeIdleFlushes) {
+			delete(s.lastKnownGauges, bucket)
 		}
 	}
 }
 
+func (s *Server) initSelfMetrics() {
+	s.metrics.Counters[s.packetsRecievedCounter] = 0
+	s.metrics.Counters[s.metricsRecievedCounter] = 0
+	s.metrics.Counters[s.errorsCounter] = 0
+	s.metrics.Counters[s.bucketsRejectedCounter] = 0
+	s.metrics.Counters[s.bucketsOverflowedCounter] = 0
+	s.metrics.Counters[s.metricsDroppedCounter] = 0
+	s.metrics.Counters[s.metricsTooOldCounter] = 0
+	s.metrics.Counters[s.samplingErrorsCounter] = 0
+}
+
+func (s *Server) isSelfMetric(bucket string) bool {
+	return bucket == s.packetsRecievedCounter || bucket == s.metricsRecievedCounter || bucket == s.errorsCounter ||
+		bucket == s.bucketsRejectedCounter || bucket == s.bucketsOverflowedCounter || bucket == s.metricsDroppedCounter ||
+		bucket == s.metricsTooOldCounter || bucket == s.samplingErrorsCounter
+}
+
+func (s *Server) isIdle(metricType metric.MetricType, bucket string, maxIdleFlushes int) bool {
+	if maxIdleFlushes <= 0 {
+		return false
+	}
+
+	idle := s.idleFlushes[metricType]
+	idle[bucket]++
+
+	if idle[bucket] > maxIdleFlushes {
+		delete(idle, bucket)
+		return true
+	}
+
+	return false
+}
+
 func setMetricsToZeroes(m map[string]float64) {
 	for bucket, _ := range m {
 		m[bucket] = 0
 	}
 }
+
+func (s *Server) resetBucketLimiter() {
+	s.bucketLimiter.Reset()
+
+	for bucket, _ := range s.metrics.Counters {
+		if !s.isSelfMetric(bucket) && bucket != s.overflowBucket {
+			s.bucketLimiter.Add(bucket)
+		}
+	}
+
+	for bucket, _ := range s.metrics.Timers {
+		s.bucketLimiter.Add(bucket)
+	}
+
+	for bucket, _ := range s.metrics.Gauges {
+		s.bucketLimiter.Add(bucket)
+	}
+
+	for bucket, _ := range s.metrics.Sets {
+		s.bucketLimiter.Add(bucket)
+	}
+
+	for bucket, _ := range s.metrics.SetSketches {
+		s.bucketLimiter.Add(bucket)
+	}
+}
@@ -0,0 +1,674 @@
+package yastatsd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evvvvr/yastatsd/internal/metric"
+)
+
+func TestServer(t *testing.T) {
+	config := DefaultConfig()
+	config.UdpServerAddress = "127.0.0.1:0"
+	config.TcpServerAddress = "127.0.0.1:0"
+
+	server, err := New(config)
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err = server.Start(ctx)
+	if err != nil {
+		t.Fatalf("Error starting server: %s", err)
+	}
+
+	defer server.Stop()
+
+	udpConn, err := net.Dial("udp", server.UDPAddr().String())
+	if err != nil {
+		t.Fatalf("Error connecting UDP: %s", err)
+	}
+
+	defer udpConn.Close()
+
+	tcpConn, err := net.Dial("tcp", server.TCPAddr().String())
+	if err != nil {
+		t.Fatalf("Error connecting TCP: %s", err)
+	}
+
+	defer tcpConn.Close()
+
+	udpConn.Write([]byte("hits:1|c\nqueue:5|g"))
+	tcpConn.Write([]byte("hits:2|c"))
+	server.HandlePacket([]byte("users:a|s"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	var snapshot Metrics
+
+	for time.Now().Before(deadline) {
+		snapshot = server.Snapshot()
+
+		if snapshot.Counters["statsd.hits"] == 3 && snapshot.Gauges["statsd.queue"] == 5 {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if snapshot.Counters["statsd.hits"] != 3 || snapshot.Gauges["statsd.queue"] != 5 ||
+		len(snapshot.Sets["statsd.users"]) != 1 {
+		t.Fatalf("Invalid server snapshot: %+v", snapshot)
+	}
+
+	server.Flush()
+
+	if counter := server.Snapshot().Counters["statsd.hits"]; counter != 0 {
+		t.Errorf("Counter must be reset after flush. Actual: %v", counter)
+	}
+}
+
+func TestNewValidatesConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.GaugeDeltaMode = "unknown"
+
+	if _, err := New(config); err == nil {
+		t.Error("Invalid gauge delta mode must be rejected")
+	}
+
+	config = DefaultConfig()
+	config.ParseMode = "unknown"
+
+	if _, err := New(config); err == nil {
+		t.Error("Invalid parse mode must be rejected")
+	}
+
+	config = DefaultConfig()
+	config.SetSketches = true
+	config.SetSketchPrecision = 30
+
+	if _, err := New(config); err == nil {
+		t.Error("Invalid set sketch precision must be rejected")
+	}
+
+	config = DefaultConfig()
+	config.SetMemberExports = []SetMemberExport{{Match: "flags", MaxMembers: -1}}
+
+	if _, err := New(config); err == nil {
+		t.Error("Invalid max set members must be rejected")
+	}
+
+	config = DefaultConfig()
+	config.TimerOverrides = []TimerOverride{{Match: "jobs.*", Fields: []string{"average"}}}
+
+	if _, err := New(config); err == nil {
+		t.Error("Unknown timer field must be rejected")
+	}
+
+	config = DefaultConfig()
+	config.Percentiles = []float64{90, 150}
+
+	if _, err := New(config); err == nil {
+		t.Error("Percentile above 100 must be rejected")
+	}
+
+	for _, pct := range []float64{0, -100.5} {
+		config = DefaultConfig()
+		config.TimerOverrides = []TimerOverride{{Match: "jobs.*", Percentiles: []float64{pct}}}
+
+		if _, err := New(config); err == nil {
+			t.Errorf("Timer override percentile %v must be rejected", pct)
+		}
+	}
+
+	config = DefaultConfig()
+	config.Percentiles = []float64{100, -100}
+
+	if _, err := New(config); err != nil {
+		t.Errorf("Percentiles of 100 and -100 must be accepted. Error: %s", err)
+	}
+}
+
+func TestBackpressurePolicy(t *testing.T) {
+	cases := []struct {
+		policy   string
+		expected []string
+	}{
+		{BACKPRESSURE_DROP_NEWEST, []string{"a", "b"}},
+		{BACKPRESSURE_DROP_OLDEST, []string{"b", "c"}},
+	}
+
+	for _, c := range cases {
+		config := DefaultConfig()
+		config.IncomingQueueSize = 2
+		config.BackpressurePolicy = c.policy
+
+		server, err := New(config)
+		if err != nil {
+			t.Fatalf("Error creating server: %s", err)
+		}
+
+		for _, bucket := range []string{"a", "b", "c"} {
+			server.enqueueMetric(&metric.Metric{Bucket: bucket, FloatValue: 1, Type: metric.Counter, Sampling: 1})
+		}
+
+		for _, bucket := range c.expected {
+			if m := <-server.incomingMetrics; m.Bucket != bucket {
+				t.Errorf("Wrong queued metric for policy %s. Expected: %s, Actual: %s", c.policy, bucket, m.Bucket)
+			}
+		}
+
+		if server.droppedMetrics != 1 {
+			t.Errorf("Wrong count of dropped metrics for policy %s. Expected: %d, Actual: %d", c.policy, 1,
+				server.droppedMetrics)
+		}
+
+		server.Flush()
+
+		if server.droppedMetrics != 0 {
+			t.Errorf("Dropped metrics must be moved to self-metric on flush for policy %s", c.policy)
+		}
+	}
+
+	config := DefaultConfig()
+	config.BackpressurePolicy = "unknown"
+
+	if _, err := New(config); err == nil {
+		t.Error("Invalid backpressure policy must be rejected")
+	}
+}
+
+func TestSampling(t *testing.T) {
+	server, err := New(DefaultConfig())
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	server.HandlePacket([]byte("hits:1|c|@0.1\nhits:1|c|@0\nhits:1|c|@5\nlatency:10|ms|@0.5\nlatency:20|ms|@0.5\n" +
+		"queue:3|g|@0.5\nusers:bob|s|@0.5"))
+
+	snapshot := server.Snapshot()
+
+	if snapshot.Counters["statsd.hits"] != 10 {
+		t.Errorf("Sampled counter must be scaled by 1/rate. Actual: %v", snapshot.Counters["statsd.hits"])
+	}
+
+	if len(snapshot.Timers["statsd.latency"]) != 2 || snapshot.TimersCount["statsd.latency"] != 4 {
+		t.Errorf("Sampled timer must keep observed values and scale its count. Actual: %v, %v",
+			snapshot.Timers["statsd.latency"], snapshot.TimersCount["statsd.latency"])
+	}
+
+	if snapshot.Gauges["statsd.queue"] != 3 || len(snapshot.Sets["statsd.users"]) != 1 {
+		t.Errorf("Sampling must be ignored for gauges and sets. Actual: %v, %v",
+			snapshot.Gauges["statsd.queue"], snapshot.Sets["statsd.users"])
+	}
+
+	if snapshot.Counters["statsd.bad_sampling_rates"] != 2 || snapshot.Counters["statsd.bad_lines_seen"] != 2 {
+		t.Errorf("Invalid sampling rates must be counted. Actual: %v, %v",
+			snapshot.Counters["statsd.bad_sampling_rates"], snapshot.Counters["statsd.bad_lines_seen"])
+	}
+}
+
+func TestSetSketches(t *testing.T) {
+	config := DefaultConfig()
+	config.SetSketches = true
+	config.PersistSets = true
+	config.StateFile = filepath.Join(t.TempDir(), "state.json")
+
+	server, err := New(config)
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		server.HandlePacket([]byte(fmt.Sprintf("users:%d|s\nusers:%d|s", i, i)))
+	}
+
+	snapshot := server.Snapshot()
+
+	if len(snapshot.Sets) != 0 {
+		t.Errorf("Sketched sets must not keep members. Actual: %v", snapshot.Sets)
+	}
+
+	if estimate := snapshot.SetSketches["statsd.users"].Estimate(); estimate < 980 || estimate > 1020 {
+		t.Errorf("Wrong set estimate. Expected: ~1000, Actual: %d", estimate)
+	}
+
+	server.saveState(config.StateFile)
+
+	restored, err := New(config)
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	restored.restoreState(config.StateFile, 0)
+
+	expected := snapshot.SetSketches["statsd.users"].Estimate()
+	if estimate := restored.Snapshot().SetSketches["statsd.users"].Estimate(); estimate != expected {
+		t.Errorf("Wrong restored set estimate. Expected: %d, Actual: %d", expected, estimate)
+	}
+}
+
+func TestGaugeDeltaModes(t *testing.T) {
+	cases := []struct {
+		mode         string
+		deleteGauges bool
+		expected     float64
+		exists       bool
+	}{
+		{GAUGE_DELTA_ZERO, false, 8, true},
+		{GAUGE_DELTA_ZERO, true, 3, true},
+		{GAUGE_DELTA_ABSOLUTE, false, 8, true},
+		{GAUGE_DELTA_ABSOLUTE, true, 3, true},
+		{GAUGE_DELTA_IGNORE, false, 8, true},
+		{GAUGE_DELTA_IGNORE, true, 0, false},
+		{GAUGE_DELTA_LAST_KNOWN, false, 8, true},
+		{GAUGE_DELTA_LAST_KNOWN, true, 8, true},
+	}
+
+	for _, c := range cases {
+		config := DefaultConfig()
+		config.GaugeDeltaMode = c.mode
+		config.DeleteGauges = c.deleteGauges
+
+		server, err := New(config)
+		if err != nil {
+			t.Fatalf("Error creating server: %s", err)
+		}
+
+		server.HandlePacket([]byte("queue:5|g"))
+		server.Flush()
+		server.HandlePacket([]byte("queue:+3|g"))
+
+		gauge, exists := server.Snapshot().Gauges["statsd.queue"]
+		if gauge != c.expected || exists != c.exists {
+			t.Errorf("Wrong gauge for mode %s, deleteGauges %t. Expected: %v, %t, Actual: %v, %t",
+				c.mode, c.deleteGauges, c.expected, c.exists, gauge, exists)
+		}
+	}
+
+	server, err := New(DefaultConfig())
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	server.HandlePacket([]byte("queue:=-4|g"))
+
+	if gauge := server.Snapshot().Gauges["statsd.queue"]; gauge != -4 {
+		t.Errorf("Wrong negative absolute gauge. Expected: %v, Actual: %v", -4, gauge)
+	}
+}
+
+func TestLastKnownGaugesExpire(t *testing.T) {
+	for _, deleteGauges := range []bool{false, true} {
+		config := DefaultConfig()
+		config.GaugeDeltaMode = GAUGE_DELTA_LAST_KNOWN
+		config.DeleteGauges = deleteGauges
+		config.GaugeIdleFlushes = 1
+
+		server, err := New(config)
+		if err != nil {
+			t.Fatalf("Error creating server: %s", err)
+		}
+
+		server.HandlePacket([]byte("queue:5|g"))
+		server.Flush()
+		server.Flush()
+
+		if len(server.lastKnownGauges) != 0 {
+			t.Errorf("Last known gauges must expire with idle gauges, deleteGauges %t. Actual: %v",
+				deleteGauges, server.lastKnownGauges)
+		}
+
+		server.HandlePacket([]byte("queue:+3|g"))
+
+		if gauge := server.Snapshot().Gauges["statsd.queue"]; gauge != 3 {
+			t.Errorf("Expired gauge must start from zero, deleteGauges %t. Actual: %v", deleteGauges, gauge)
+		}
+	}
+}
+
+func TestIdleBucketsExpire(t *testing.T) {
+	config := DefaultConfig()
+	config.CounterIdleFlushes = 1
+	config.TimerIdleFlushes = 1
+	config.GaugeIdleFlushes = 1
+	config.SetIdleFlushes = 1
+
+	server, err := New(config)
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	server.HandlePacket([]byte("hits:1|c\nlatency:10|ms\nqueue:5|g\nusers:bob|s"))
+
+	buckets := func() []bool {
+		snapshot := server.Snapshot()
+		_, counter := snapshot.Counters["statsd.hits"]
+		_, timer := snapshot.Timers["statsd.latency"]
+		_, timerCount := snapshot.TimersCount["statsd.latency"]
+		_, gauge := snapshot.Gauges["statsd.queue"]
+		_, set := snapshot.Sets["statsd.users"]
+
+		return []bool{counter, timer, timerCount, gauge, set}
+	}
+
+	server.Flush()
+
+	for i, exists := range buckets() {
+		if !exists {
+			t.Errorf("Bucket %d must be kept for one idle flush", i)
+		}
+	}
+
+	server.Flush()
+
+	for i, exists := range buckets() {
+		if exists {
+			t.Errorf("Bucket %d must expire after idle flushes", i)
+		}
+	}
+
+	if _, exists := server.Snapshot().Counters["statsd.packets_recieved"]; !exists {
+		t.Error("Self metrics must never expire")
+	}
+}
+
+func TestIdleBucketsKeptWhenUpdated(t *testing.T) {
+	config := DefaultConfig()
+	config.CounterIdleFlushes = 1
+
+	server, err := New(config)
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		server.HandlePacket([]byte("hits:1|c"))
+		server.Flush()
+	}
+
+	if _, exists := server.Snapshot().Counters["statsd.hits"]; !exists {
+		t.Error("Updated bucket must not expire")
+	}
+}
+
+func TestSelfMetricsAndTimerCountsReset(t *testing.T) {
+	server, err := New(DefaultConfig())
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	server.HandlePacket([]byte("latency:10|ms|@0.5"))
+
+	snapshot := server.Snapshot()
+
+	if snapshot.Counters["statsd.packets_recieved"] != 1 || snapshot.Counters["statsd.metrics_recieved"] != 1 {
+		t.Errorf("Self metrics must use processed bucket names. Actual: %v", snapshot.Counters)
+	}
+
+	if _, exists := snapshot.Counters[""]; exists {
+		t.Errorf("Self metrics must not be counted under an empty bucket. Actual: %v", snapshot.Counters)
+	}
+
+	server.Flush()
+
+	if count := server.Snapshot().TimersCount["statsd.latency"]; count != 0 {
+		t.Errorf("Timer count must be reset after flush. Actual: %v", count)
+	}
+
+	config := DefaultConfig()
+	config.DeleteTimers = true
+
+	server, err = New(config)
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	server.HandlePacket([]byte("latency:10|ms"))
+	server.Flush()
+
+	if counts := server.Snapshot().TimersCount; len(counts) != 0 {
+		t.Errorf("Timer counts must be deleted with timers. Actual: %v", counts)
+	}
+}
+
+func TestBucketLimits(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxBuckets = 2
+	config.DenyBuckets = []string{"^statsd\\.secret"}
+
+	server, err := New(config)
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		server.HandlePacket([]byte("a:1|c\nb:1|c\nc:1|c\nd:1|g\nsecret:1|c"))
+
+		snapshot := server.Snapshot()
+
+		if snapshot.Counters["statsd.a"] != 1 || snapshot.Counters["statsd.b"] != 1 {
+			t.Errorf("Buckets under the limit must be kept. Actual: %v", snapshot.Counters)
+		}
+
+		if _, exists := snapshot.Counters["statsd.c"]; exists {
+			t.Errorf("Buckets over the limit must not be kept. Actual: %v", snapshot.Counters)
+		}
+
+		if snapshot.Counters["statsd.__overflow__"] != 1 || snapshot.Gauges["statsd.__overflow__"] != 1 {
+			t.Errorf("Buckets over the limit must be folded into the overflow bucket. Actual: %v, %v",
+				snapshot.Counters, snapshot.Gauges)
+		}
+
+		if snapshot.Counters["statsd.buckets_overflowed"] != 2 || snapshot.Counters["statsd.buckets_rejected"] != 1 {
+			t.Errorf("Overflowed and rejected buckets must be counted. Actual: %v", snapshot.Counters)
+		}
+
+		if _, exists := snapshot.Counters["statsd.secret"]; exists {
+			t.Errorf("Denied bucket must be rejected. Actual: %v", snapshot.Counters)
+		}
+
+		server.Flush()
+	}
+}
+
+func TestBucketRules(t *testing.T) {
+	config := DefaultConfig()
+	config.BucketRules = []BucketRule{
+		{Match: "app.*.request", Replace: "app.request", Tags: map[string]string{"host": "$1"}},
+		{Regex: "^(.*)_recieved$", Replace: "${1}_received"}}
+
+	server, err := New(config)
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	server.HandlePacket([]byte("app.web 01.request:1|c\nother;env=prod;bad key=x:1|c\njobs_recieved:1|c"))
+
+	counters := server.Snapshot().Counters
+
+	for _, b := range []string{"statsd.app.request;host=web_01", "statsd.other;bad_key=x;env=prod",
+		"statsd.jobs_received", "statsd.packets_recieved"} {
+		if counters[b] != 1 {
+			t.Errorf("Bucket %s must be counted. Actual: %v", b, counters)
+		}
+	}
+}
+
+func TestTaggedMetrics(t *testing.T) {
+	server, err := New(DefaultConfig())
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	server.HandlePacket([]byte("hits:1|c|#env:prod,host:a\nhits:2|c|#host:a,env:prod\nhits;env=dev:4|c|#env:prod\n" +
+		"queue:5|g|#host:web 01\nusers:a|s|#env:prod\nbad:1|c|#env"))
+
+	snapshot := server.Snapshot()
+
+	if counter := snapshot.Counters["statsd.hits;env=prod;host=a"]; counter != 3 {
+		t.Errorf("Tags must be merged regardless of order. Actual: %v", snapshot.Counters)
+	}
+
+	if counter := snapshot.Counters["statsd.hits;env=prod"]; counter != 4 {
+		t.Errorf("Metric tags must override bucket tags. Actual: %v", snapshot.Counters)
+	}
+
+	if gauge, exists := snapshot.Gauges["statsd.queue;host=web_01"]; !exists || gauge != 5 {
+		t.Errorf("Tag values must be sanitized. Actual: %v", snapshot.Gauges)
+	}
+
+	if _, exists := snapshot.Sets["statsd.users;env=prod"]; !exists {
+		t.Errorf("Tagged set must be saved. Actual: %v", snapshot.Sets)
+	}
+
+	if errors := snapshot.Counters["statsd.bad_lines_seen"]; errors != 1 {
+		t.Errorf("Invalid tags must be counted as error. Actual: %v", snapshot.Counters)
+	}
+}
+
+func TestFlushDoesNotBlockIngestion(t *testing.T) {
+	received := make(chan struct{}, 1)
+	release := make(chan struct{})
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+	}))
+
+	defer backend.Close()
+
+	config := DefaultConfig()
+	config.UdpServerAddress = "127.0.0.1:0"
+	config.FlushInterval = 1000
+	config.HTTP = HTTPConfig{Address: backend.URL}
+
+	server, err := New(config)
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	server.clock = clock
+
+	err = server.Start(context.Background())
+	if err != nil {
+		t.Fatalf("Error starting server: %s", err)
+	}
+
+	defer server.Stop()
+	defer close(release)
+
+	clock.Advance(time.Second)
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Flush must be sent to HTTP backend")
+	}
+
+	conn, err := net.Dial("udp", server.UDPAddr().String())
+	if err != nil {
+		t.Fatalf("Error connecting UDP: %s", err)
+	}
+
+	defer conn.Close()
+
+	conn.Write([]byte("hits:1|c"))
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for server.Snapshot().Counters["statsd.hits"] != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if counter := server.Snapshot().Counters["statsd.hits"]; counter != 1 {
+		t.Errorf("Metrics received over UDP must be aggregated while backends are flushed to. Actual: %v", counter)
+	}
+}
+
+func TestStopClosesConnections(t *testing.T) {
+	config := DefaultConfig()
+	config.UdpServerAddress = ""
+	config.TcpServerAddress = "127.0.0.1:0"
+
+	server, err := New(config)
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	err = server.Start(context.Background())
+	if err != nil {
+		t.Fatalf("Error starting server: %s", err)
+	}
+
+	tcpConn, err := net.Dial("tcp", server.TCPAddr().String())
+	if err != nil {
+		t.Fatalf("Error connecting TCP: %s", err)
+	}
+
+	defer tcpConn.Close()
+
+	tcpConn.Write([]byte("hits:1|c"))
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for server.Snapshot().Counters["statsd.hits"] != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	server.Stop()
+
+	tcpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = tcpConn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); err == nil || ok && netErr.Timeout() {
+		t.Errorf("Connection must be closed by Stop. Read error: %v", err)
+	}
+}
+
+func TestSetMembersInFlushDocument(t *testing.T) {
+	var doc flushDocument
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := json.NewDecoder(r.Body).Decode(&doc)
+		if err != nil {
+			t.Errorf("Error decoding request: %s", err)
+		}
+	}))
+
+	defer backend.Close()
+
+	config := DefaultConfig()
+	config.HTTP = HTTPConfig{Address: backend.URL}
+	config.SetMemberExports = []SetMemberExport{{Match: "statsd.flags"}}
+
+	server, err := New(config)
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	server.HandlePacket([]byte("flags:beta|s\nflags:alpha|s"))
+	server.Flush()
+
+	if members := doc.Members["statsd.flags"]; len(members) != 2 || members[0] != "alpha" || members[1] != "beta" {
+		t.Errorf("Set members must be listed in flush document. Actual: %v", doc.Members)
+	}
+
+	for b := range doc.Counters {
+		if strings.Contains(b, ".members.") {
+			t.Errorf("Set members must only be Graphite counters. Actual: %v", doc.Counters)
+		}
+	}
+}
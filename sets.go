@@ -0,0 +1,137 @@
+package yastatsd
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/evvvvr/yastatsd/internal/bucket"
+	"github.com/evvvvr/yastatsd/internal/metric"
+	"github.com/evvvvr/yastatsd/internal/util"
+)
+
+const DEFAULT_MAX_EXPORTED_SET_MEMBERS = 100
+
+// SetMemberExport makes backends receive the members of matching sets, not
+// only their count. Members are sorted and at most MaxMembers are exported;
+// sets backed by sketches have no members to export. Flush documents list
+// them under setMembers and Graphite gets a counter per member.
+type SetMemberExport struct {
+	Match      string `yaml:"match"`
+	Regex      string `yaml:"regex"`
+	MaxMembers int    `yaml:"maxMembers"`
+}
+
+type compiledSetMemberExport struct {
+	re         *regexp.Regexp
+	maxMembers int
+}
+
+func compileSetMemberExports(exports []SetMemberExport) ([]compiledSetMemberExport, error) {
+	compiled := make([]compiledSetMemberExport, 0, len(exports))
+
+	for _, export := range exports {
+		re, err := bucket.CompilePattern(export.Match, export.Regex)
+		if err != nil {
+			return nil, err
+		}
+
+		if re == nil {
+			return nil, fmt.Errorf("Set member export must have match or regex")
+		}
+
+		if export.MaxMembers < 0 {
+			return nil, fmt.Errorf("Invalid max set members: %d", export.MaxMembers)
+		}
+
+		maxMembers := export.MaxMembers
+		if maxMembers == 0 {
+			maxMembers = DEFAULT_MAX_EXPORTED_SET_MEMBERS
+		}
+
+		compiled = append(compiled, compiledSetMemberExport{re: re, maxMembers: maxMembers})
+	}
+
+	return compiled, nil
+}
+
+func (s *Server) exportSetMembers(m *metric.CalculatedMetrics) *metric.CalculatedMetrics {
+	if len(s.setMemberExports) == 0 {
+		return m
+	}
+
+	res := *m
+	res.SetMembers = make(map[string][]string)
+
+	for _, b := range util.SortMapKeys(m.Sets) {
+		export := s.setMemberExport(b)
+		if export == nil {
+			continue
+		}
+
+		members := util.SortMapKeys(m.Sets[b])
+
+		if len(members) > export.maxMembers {
+			members = members[:export.maxMembers]
+		}
+
+		res.SetMembers[b] = members
+	}
+
+	return &res
+}
+
+// Graphite has no place for set members, so there they become counters named
+// <set>.members.<member>, counted once per interval. A member is skipped, and
+// logged, if its name is empty after sanitizing or the counter is already
+// taken, e.g. by "beta.ui" and "beta_ui" which both become "beta_ui".
+func (s *Server) addSetMemberCounters(m *metric.CalculatedMetrics) *metric.CalculatedMetrics {
+	if len(m.SetMembers) == 0 {
+		return m
+	}
+
+	res := *m
+	res.Counters = make(map[string]metric.CounterData, len(m.Counters))
+
+	for b, counter := range m.Counters {
+		res.Counters[b] = counter
+	}
+
+	memberCounter := metric.CounterData{Value: 1, Rate: 1 / float64(s.config.FlushInterval/1000)}
+
+	for _, b := range util.SortMapKeys(m.SetMembers) {
+		name, tags := bucket.SplitTags(b)
+
+		for _, member := range m.SetMembers[b] {
+			memberName := strings.Replace(sanitizeBucketName(member), ".", "_", -1)
+			if memberName == "" {
+				log.Printf("Skipping member %q of set %s - name is empty after sanitizing", member, b)
+				continue
+			}
+
+			memberBucket := bucket.JoinTags(name+".members."+memberName, tags)
+
+			if _, exists := res.Counters[memberBucket]; exists {
+				log.Printf("Skipping member %q of set %s - %s is already exported", member, b, memberBucket)
+				continue
+			}
+
+			res.Counters[memberBucket] = memberCounter
+		}
+	}
+
+	return &res
+}
+
+func (s *Server) setMemberExport(b string) *compiledSetMemberExport {
+	name, _ := bucket.SplitTags(b)
+
+	for i := range s.setMemberExports {
+		if s.setMemberExports[i].re.MatchString(name) {
+			return &s.setMemberExports[i]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,207 @@
+package yastatsd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/evvvvr/yastatsd/internal/hll"
+	"github.com/evvvvr/yastatsd/internal/util"
+)
+
+type state struct {
+	Timestamp       int64                `json:"timestamp"`
+	Counters        map[string]float64   `json:"counters,omitempty"`
+	Timers          map[string][]float64 `json:"timers,omitempty"`
+	TimersCount     map[string]float64   `json:"timersCount,omitempty"`
+	Gauges          map[string]float64   `json:"gauges"`
+	LastKnownGauges map[string]float64   `json:"lastKnownGauges,omitempty"`
+	Sets            map[string][]string  `json:"sets,omitempty"`
+	SetSketches     map[string][]byte    `json:"setSketches,omitempty"`
+}
+
+// State is saved after every flush and on Stop. A flush saves it after the
+// metrics were reset, so only gauges carry over from it; pending
+// counters, timers and sets are persisted by the save on Stop; saving them
+// before the reset would count them twice after a restart.
+func (s *Server) saveState(stateFile string) {
+	data, err := s.encodeState()
+	if err != nil {
+		log.Printf("Error encoding state: %s", err)
+		return
+	}
+
+	writeStateFile(stateFile, data)
+}
+
+func (s *Server) encodeState() ([]byte, error) {
+	st := state{Timestamp: s.clock.Now().Unix(),
+		Gauges:          finiteValues("gauge", s.metrics.Gauges),
+		LastKnownGauges: finiteValues("last known gauge", s.lastKnownGauges)}
+
+	if s.config.PersistCounters {
+		st.Counters = finiteValues("counter", s.metrics.Counters)
+	}
+
+	if s.config.PersistTimers {
+		st.Timers = s.metrics.Timers
+		st.TimersCount = s.metrics.TimersCount
+	}
+
+	if s.config.PersistSets {
+		st.Sets = make(map[string][]string)
+
+		for bucket, set := range s.metrics.Sets {
+			st.Sets[bucket] = util.SortMapKeys(set)
+		}
+
+		st.SetSketches = make(map[string][]byte)
+
+		for bucket, sketch := range s.metrics.SetSketches {
+			st.SetSketches[bucket] = sketch.Bytes()
+		}
+	}
+
+	return json.Marshal(&st)
+}
+
+// JSON has no NaN or infinity, so a counter or gauge which overflowed is left
+// out instead of failing the whole state.
+func finiteValues(kind string, m map[string]float64) map[string]float64 {
+	res := m
+
+	for bucket, value := range m {
+		if !math.IsNaN(value) && !math.IsInf(value, 0) {
+			continue
+		}
+
+		log.Printf("Skipping %s %s in state - %v can't be saved", kind, bucket, value)
+
+		if len(res) == len(m) {
+			res = make(map[string]float64, len(m))
+
+			for b, v := range m {
+				res[b] = v
+			}
+		}
+
+		delete(res, bucket)
+	}
+
+	return res
+}
+
+func writeStateFile(stateFile string, data []byte) {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(stateFile), filepath.Base(stateFile))
+	if err != nil {
+		log.Printf("Error writing state file %s - %s", stateFile, err)
+		return
+	}
+
+	_, err = tmpFile.Write(data)
+	closeErr := tmpFile.Close()
+
+	if err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), stateFile)
+	}
+
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		log.Printf("Error writing state file %s - %s", stateFile, err)
+	}
+}
+
+func (s *Server) restoreState(stateFile string, maxAge time.Duration) {
+	data, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading state file %s - %s", stateFile, err)
+		}
+
+		return
+	}
+
+	var st state
+
+	err = json.Unmarshal(data, &st)
+	if err != nil {
+		log.Printf("Error decoding state file %s - %s", stateFile, err)
+		return
+	}
+
+	age := s.clock.Now().Sub(time.Unix(st.Timestamp, 0))
+
+	if maxAge > 0 && age > maxAge {
+		log.Printf("Ignoring state file %s saved %s ago", stateFile, age)
+		return
+	}
+
+	for bucket, gauge := range st.Gauges {
+		s.metrics.Gauges[bucket] = gauge
+	}
+
+	for bucket, gauge := range st.LastKnownGauges {
+		s.lastKnownGauges[bucket] = gauge
+	}
+
+	for bucket, counter := range st.Counters {
+		s.metrics.Counters[bucket] += counter
+	}
+
+	for bucket, points := range st.Timers {
+		s.metrics.Timers[bucket] = append(s.metrics.Timers[bucket], points...)
+	}
+
+	for bucket, count := range st.TimersCount {
+		s.metrics.TimersCount[bucket] += count
+	}
+
+	for bucket, values := range st.Sets {
+		if s.config.SetSketches {
+			sketch := s.setSketch(&s.metrics, bucket)
+
+			for _, value := range values {
+				sketch.Add(value)
+			}
+
+			continue
+		}
+
+		set, exists := s.metrics.Sets[bucket]
+
+		if !exists {
+			set = make(map[string]struct{})
+			s.metrics.Sets[bucket] = set
+		}
+
+		for _, value := range values {
+			set[value] = struct{}{}
+		}
+	}
+
+	for bucket, registers := range st.SetSketches {
+		if !s.config.SetSketches {
+			log.Printf("Ignoring set sketch %s from state file %s - set sketches are disabled", bucket, stateFile)
+			continue
+		}
+
+		sketch, err := hll.FromBytes(registers)
+		if err == nil {
+			err = s.setSketch(&s.metrics, bucket).Merge(sketch)
+		}
+
+		if err != nil {
+			log.Printf("Error restoring set sketch %s from state file %s - %s", bucket, stateFile, err)
+		}
+	}
+
+	log.Printf("Restored state from %s saved %s ago", stateFile, age)
+}
@@ -0,0 +1,140 @@
+package yastatsd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newStateTestConfig(t *testing.T) Config {
+	config := DefaultConfig()
+	config.StateFile = filepath.Join(t.TempDir(), "state.json")
+	config.PersistCounters = true
+	config.PersistTimers = true
+	config.PersistSets = true
+
+	return config
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	config := newStateTestConfig(t)
+
+	server, err := New(config)
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	server.HandlePacket([]byte("hits:2|c\nlatency:10|ms|@0.5\nqueue:5|g\nusers:bob|s"))
+	server.Stop()
+
+	restored, err := New(config)
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	snapshot := restored.Snapshot()
+
+	if snapshot.Counters["statsd.hits"] != 2 || snapshot.Gauges["statsd.queue"] != 5 ||
+		len(snapshot.Timers["statsd.latency"]) != 1 || snapshot.TimersCount["statsd.latency"] != 2 ||
+		len(snapshot.Sets["statsd.users"]) != 1 {
+		t.Errorf("Invalid restored snapshot: %+v", snapshot)
+	}
+}
+
+func TestStateAfterFlush(t *testing.T) {
+	config := newStateTestConfig(t)
+
+	server, err := New(config)
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	server.HandlePacket([]byte("hits:2|c\nqueue:5|g"))
+	server.Flush()
+
+	data, err := ioutil.ReadFile(config.StateFile)
+	if err != nil {
+		t.Fatalf("Error reading state file: %s", err)
+	}
+
+	var st state
+
+	err = json.Unmarshal(data, &st)
+	if err != nil {
+		t.Fatalf("Error decoding state file: %s", err)
+	}
+
+	if st.Gauges["statsd.queue"] != 5 || st.Counters["statsd.hits"] != 0 {
+		t.Errorf("Flushed counters must not be persisted again. Actual: %+v", st)
+	}
+}
+
+func TestStateMaxAge(t *testing.T) {
+	config := newStateTestConfig(t)
+	config.StateMaxAge = 60000
+
+	server, err := New(config)
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	server.clock = newFakeClock(time.Now().Add(-2 * time.Minute))
+	server.HandlePacket([]byte("queue:5|g"))
+	server.Stop()
+
+	restored, err := New(config)
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	if gauges := restored.Snapshot().Gauges; len(gauges) != 0 {
+		t.Errorf("Stale state must be ignored. Actual: %v", gauges)
+	}
+}
+
+func TestStateCorruptFile(t *testing.T) {
+	config := newStateTestConfig(t)
+
+	err := ioutil.WriteFile(config.StateFile, []byte(`{"gauges": {"statsd.queue": `), 0644)
+	if err != nil {
+		t.Fatalf("Error writing state file: %s", err)
+	}
+
+	server, err := New(config)
+	if err != nil {
+		t.Fatalf("Corrupt state file must not prevent starting: %s", err)
+	}
+
+	if gauges := server.Snapshot().Gauges; len(gauges) != 0 {
+		t.Errorf("Corrupt state must be ignored. Actual: %v", gauges)
+	}
+}
+
+func TestStateSkipsNonFiniteValues(t *testing.T) {
+	config := newStateTestConfig(t)
+
+	server, err := New(config)
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	server.HandlePacket([]byte("big:1e308|g\nbig:+1e308|g\nhits:1e308|c\nhits:1e308|c\nqueue:5|g"))
+	server.Stop()
+
+	restored, err := New(config)
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	snapshot := restored.Snapshot()
+
+	if _, exists := snapshot.Gauges["statsd.big"]; exists || snapshot.Gauges["statsd.queue"] != 5 {
+		t.Errorf("Overflowed gauge must be skipped and others saved. Actual: %v", snapshot.Gauges)
+	}
+
+	if _, exists := snapshot.Counters["statsd.hits"]; exists || snapshot.Counters["statsd.metrics_recieved"] != 5 {
+		t.Errorf("Overflowed counter must be skipped and others saved. Actual: %v", snapshot.Counters)
+	}
+}
@@ -0,0 +1,125 @@
+package yastatsd
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+
+	"github.com/evvvvr/yastatsd/internal/bucket"
+	"github.com/evvvvr/yastatsd/internal/metric"
+	"github.com/evvvvr/yastatsd/internal/util"
+)
+
+// TimerOverride applies to timers whose bucket name, without tags, matches.
+// The first matching override wins. A list set on the override replaces the
+// global one for matching timers: Percentiles replaces Config.Percentiles,
+// Fields replaces Config.TimerFields and PercentileFields replaces
+// Config.PercentileFields. Lists left unset are inherited from Config, and
+// an empty list selects nothing.
+type TimerOverride struct {
+	Match            string    `yaml:"match"`
+	Regex            string    `yaml:"regex"`
+	Percentiles      []float64 `yaml:"percentiles"`
+	Fields           []string  `yaml:"fields"`
+	PercentileFields []string  `yaml:"percentileFields"`
+}
+
+type compiledTimerOverride struct {
+	re    *regexp.Regexp
+	stats metric.TimerStats
+}
+
+func compileTimerStats(config *Config) (metric.TimerStats, []compiledTimerOverride, error) {
+	defaults, err := resolveTimerStats(metric.TimerStats{Percentiles: config.Percentiles},
+		config.TimerFields, config.PercentileFields)
+	if err != nil {
+		return defaults, nil, err
+	}
+
+	overrides := make([]compiledTimerOverride, 0, len(config.TimerOverrides))
+
+	for _, override := range config.TimerOverrides {
+		re, err := bucket.CompilePattern(override.Match, override.Regex)
+		if err != nil {
+			return defaults, nil, err
+		}
+
+		if re == nil {
+			return defaults, nil, fmt.Errorf("Timer override must have match or regex")
+		}
+
+		stats := defaults
+		if override.Percentiles != nil {
+			stats.Percentiles = override.Percentiles
+		}
+
+		stats, err = resolveTimerStats(stats, override.Fields, override.PercentileFields)
+		if err != nil {
+			return defaults, nil, err
+		}
+
+		overrides = append(overrides, compiledTimerOverride{re: re, stats: stats})
+	}
+
+	return defaults, overrides, nil
+}
+
+func resolveTimerStats(stats metric.TimerStats, fields []string, pctFields []string) (metric.TimerStats, error) {
+	for _, pct := range stats.Percentiles {
+		if util.CmpToZero(pct) == 0 || !(math.Abs(pct) <= 100) {
+			return stats, fmt.Errorf("Invalid percentile %v, must be within [-100, 0) or (0, 100]", pct)
+		}
+	}
+
+	if fields != nil {
+		selected, err := metric.ParseTimerFields(fields)
+		if err != nil {
+			return stats, err
+		}
+
+		stats.OmitFields = metric.AllTimerFields &^ selected
+	}
+
+	if pctFields != nil {
+		selected, err := metric.ParsePercentileFields(pctFields)
+		if err != nil {
+			return stats, err
+		}
+
+		stats.OmitPctFields = metric.AllPercentileFields &^ selected
+	}
+
+	return stats, nil
+}
+
+func (s *Server) timerStats(b string) metric.TimerStats {
+	name, _ := bucket.SplitTags(b)
+
+	for _, override := range s.timerOverrides {
+		if override.re.MatchString(name) {
+			return override.stats
+		}
+	}
+
+	return s.defaultTimerStats
+}
+
+func (s *Server) skipEmptyMetrics(m *metric.CalculatedMetrics) *metric.CalculatedMetrics {
+	res := *m
+	res.Counters = make(map[string]metric.CounterData, len(m.Counters))
+	res.Timers = make(map[string]metric.TimerData, len(m.Timers))
+
+	for b, counter := range m.Counters {
+		if util.CmpToZero(counter.Value) != 0 || s.isSelfMetric(b) {
+			res.Counters[b] = counter
+		}
+	}
+
+	for b, timer := range m.Timers {
+		if len(timer.Points) > 0 {
+			res.Timers[b] = timer
+		}
+	}
+
+	return &res
+}